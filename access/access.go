@@ -28,30 +28,30 @@ import (
 
 type Acl []struct {
 	Allow bool
-	Cidr  myIPNet
+	Cidr  IPNet
 }
 
 type Config map[string]Acl
 
-type myIPNet struct {
+type IPNet struct {
 	*net.IPNet
 }
 
-func (myIPNet *myIPNet) UnmarshalYAML(unmarshal func(v interface{}) error) (err error) {
+func (ipNet *IPNet) UnmarshalYAML(unmarshal func(v interface{}) error) (err error) {
 	var ipstring string
 	if err = unmarshal(&ipstring); err != nil {
 		return
 	}
-	_, myIPNet.IPNet, err = net.ParseCIDR(ipstring)
+	_, ipNet.IPNet, err = net.ParseCIDR(ipstring)
 	return err
 }
 
-func (myIPNet *myIPNet) UnmarshalTOML(d interface{}) (err error) {
+func (ipNet *IPNet) UnmarshalTOML(d interface{}) (err error) {
 	ipstring, ok := d.(string)
 	if !ok {
 		return errors.New("Expected string")
 	}
-	_, myIPNet.IPNet, err = net.ParseCIDR(ipstring)
+	_, ipNet.IPNet, err = net.ParseCIDR(ipstring)
 	return err
 }
 
@@ -0,0 +1,271 @@
+//
+// accesslog.go
+//
+// Copyright © 2015 Janne Snabb <snabb AT epipe.com>
+//
+// This file is part of Flixproxy.
+//
+// Flixproxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Flixproxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Flixproxy. If not, see <http://www.gnu.org/licenses/>.
+//
+
+package accesslog
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Config struct {
+	Destination string // filename, stderr or stdout
+	Format      string // combined or json
+}
+
+// Entry describes one HTTP request or TLS connection.
+type Entry struct {
+	Start       time.Time
+	Client      net.Addr
+	RequestId   string
+	User        string // authenticated user
+	Host        string
+	RequestLine string
+	Status      int
+	Referer     string
+	UserAgent   string
+	Sni         string
+	BytesIn     int64 // bytes forwarded from the client
+	BytesOut    int64 // bytes sent to the client
+	Upstream    string
+	Upgrade     string // protocol the connection was upgraded to
+	Cache       string // cache status
+	Reason      string // termination reason
+}
+
+// Logger writes access log entries to a destination. A nil Logger
+// discards the entries.
+type Logger struct {
+	id     string
+	format string
+	dest   *destination
+}
+
+type destination struct {
+	mutex  sync.Mutex
+	name   string
+	writer io.Writer
+	file   *os.File
+}
+
+var (
+	destinationsMutex sync.Mutex
+	destinations      = make(map[string]*destination)
+)
+
+func (dest *destination) open() (err error) {
+	switch dest.name {
+	case "stdout":
+		dest.writer = os.Stdout
+	case "stderr":
+		dest.writer = os.Stderr
+	default:
+		file, err := os.OpenFile(dest.name, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		if dest.file != nil {
+			dest.file.Close()
+		}
+		dest.file = file
+		dest.writer = file
+	}
+	return nil
+}
+
+// Open returns a Logger for the configured destination or nil if access
+// logging is not configured. Loggers with the same destination share the
+// underlying file. Id identifies the proxy instance in the entries.
+func Open(config Config, id string) (logger *Logger, err error) {
+	if config.Destination == "" {
+		return nil, nil
+	}
+	switch config.Format {
+	case "", "combined":
+		config.Format = "combined"
+	case "json":
+	default:
+		return nil, errors.New("invalid access log format " + strconv.Quote(config.Format))
+	}
+	destinationsMutex.Lock()
+	defer destinationsMutex.Unlock()
+
+	dest, ok := destinations[config.Destination]
+	if !ok {
+		dest = &destination{name: config.Destination}
+		if err = dest.open(); err != nil {
+			return nil, err
+		}
+		destinations[config.Destination] = dest
+	}
+	return &Logger{id: id, format: config.Format, dest: dest}, nil
+}
+
+// ReopenAll reopens all access log files, for example after log rotation.
+func ReopenAll() (err error) {
+	destinationsMutex.Lock()
+	defer destinationsMutex.Unlock()
+
+	for _, dest := range destinations {
+		dest.mutex.Lock()
+		if e := dest.open(); e != nil {
+			err = e
+		}
+		dest.mutex.Unlock()
+	}
+	return err
+}
+
+func clientIP(addr net.Addr) string {
+	if addr == nil {
+		return "-"
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// quote quotes s escaping quotes, backslashes and control characters so
+// that values sent by clients can not forge fields or entries.
+func quote(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < 0x20 || c == 0x7f:
+			fmt.Fprintf(&b, "\\x%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+func (logger *Logger) formatCombined(entry *Entry, duration time.Duration) string {
+	status := "-"
+	if entry.Status != 0 {
+		status = strconv.Itoa(entry.Status)
+	}
+	bytesOut := "-"
+	if entry.BytesOut != 0 {
+		bytesOut = strconv.FormatInt(entry.BytesOut, 10)
+	}
+	request := entry.RequestLine
+	if request == "" {
+		request = "-"
+	}
+	line := fmt.Sprintf("%s - %s [%s] %s %s %s %s %s",
+		clientIP(entry.Client), orDash(entry.User), entry.Start.Format("02/Jan/2006:15:04:05 -0700"),
+		quote(request), status, bytesOut,
+		quote(orDash(entry.Referer)), quote(orDash(entry.UserAgent)))
+	line += fmt.Sprintf(" host=%s sni=%s upstream=%s bytes_in=%d duration=%.3f reason=%s reqid=%s",
+		quote(orDash(entry.Host)), quote(orDash(entry.Sni)), quote(orDash(entry.Upstream)), entry.BytesIn,
+		duration.Seconds(), quote(entry.Reason), orDash(entry.RequestId))
+	if entry.Upgrade != "" {
+		line += " upgrade=" + quote(entry.Upgrade)
+	}
+	if entry.Cache != "" {
+		line += " cache=" + entry.Cache
+	}
+	if logger.id != "" {
+		line += " id=" + logger.id
+	}
+	return line + "\n"
+}
+
+func (logger *Logger) formatJson(entry *Entry, duration time.Duration) string {
+	record := map[string]interface{}{
+		"time":      entry.Start.Format(time.RFC3339Nano),
+		"client":    clientIP(entry.Client),
+		"bytes_in":  entry.BytesIn,
+		"bytes_out": entry.BytesOut,
+		"duration":  duration.Seconds(),
+		"reason":    entry.Reason,
+	}
+	optional := map[string]string{
+		"id":         logger.id,
+		"reqid":      entry.RequestId,
+		"user":       entry.User,
+		"host":       entry.Host,
+		"request":    entry.RequestLine,
+		"referer":    entry.Referer,
+		"user_agent": entry.UserAgent,
+		"sni":        entry.Sni,
+		"upstream":   entry.Upstream,
+		"upgrade":    entry.Upgrade,
+		"cache":      entry.Cache,
+	}
+	for key, value := range optional {
+		if value != "" {
+			record[key] = value
+		}
+	}
+	if entry.Status != 0 {
+		record["status"] = entry.Status
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		return ""
+	}
+	return string(line) + "\n"
+}
+
+// Log writes the entry. The duration is measured from entry.Start.
+func (logger *Logger) Log(entry *Entry) {
+	if logger == nil {
+		return
+	}
+	duration := time.Since(entry.Start)
+
+	var line string
+	if logger.format == "json" {
+		line = logger.formatJson(entry, duration)
+	} else {
+		line = logger.formatCombined(entry, duration)
+	}
+	logger.dest.mutex.Lock()
+	defer logger.dest.mutex.Unlock()
+
+	io.WriteString(logger.dest.writer, line)
+}
+
+// eof
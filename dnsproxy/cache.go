@@ -0,0 +1,262 @@
+//
+// cache.go
+//
+// Copyright © 2015 Janne Snabb <snabb AT epipe.com>
+//
+// This file is part of Flixproxy.
+//
+// Flixproxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Flixproxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Flixproxy. If not, see <http://www.gnu.org/licenses/>.
+//
+
+package dnsproxy
+
+import (
+	"container/list"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// CacheConfig defines the response cache for forwarded answers. Stale
+// answers are served according to RFC 8767 when the forwarder fails.
+type CacheConfig struct {
+	Size         int   // maximum number of cached responses, 0 disables
+	Stale        int64 // maximum stale age (s)
+	Stalettl     int64 // TTL of stale answers (s), default 30
+	Prefetch     int64 // prefetch time before expiry (s), 0 disables
+	Prefetchhits int   // minimum number of hits before prefetching
+}
+
+// TTL of stale answers recommended by RFC 8767 section 4
+const defaultStaleTtl = 30
+
+type cacheKey struct {
+	name   string
+	qtype  uint16
+	qclass uint16
+	do     bool
+}
+
+type cacheEntry struct {
+	key         cacheKey
+	req         *dns.Msg
+	msg         *dns.Msg
+	stored      time.Time
+	expires     time.Time
+	hits        int
+	prefetching bool
+	element     *list.Element
+}
+
+type responseCache struct {
+	config  CacheConfig
+	mutex   sync.Mutex
+	entries map[cacheKey]*cacheEntry
+	lru     *list.List
+}
+
+func newResponseCache(config CacheConfig) *responseCache {
+	if config.Size <= 0 {
+		return nil
+	}
+	if config.Stalettl <= 0 {
+		config.Stalettl = defaultStaleTtl
+	}
+	return &responseCache{
+		config:  config,
+		entries: make(map[cacheKey]*cacheEntry),
+		lru:     list.New(),
+	}
+}
+
+func makeCacheKey(req *dns.Msg) cacheKey {
+	q := req.Question[0]
+	key := cacheKey{
+		name:   strings.ToLower(q.Name),
+		qtype:  q.Qtype,
+		qclass: q.Qclass,
+	}
+	if opt := req.IsEdns0(); opt != nil {
+		key.do = opt.Do()
+	}
+	return key
+}
+
+// responseTtl returns the time the response may be cached for. Negative
+// answers are cached according to the SOA record as in RFC 2308.
+func responseTtl(msg *dns.Msg) (ttl uint32, ok bool) {
+	if msg.Truncated {
+		return 0, false
+	}
+	switch msg.Rcode {
+	case dns.RcodeSuccess, dns.RcodeNameError:
+	default:
+		return 0, false
+	}
+	first := true
+	for _, rr := range append(append([]dns.RR{}, msg.Answer...), msg.Ns...) {
+		rrTtl := rr.Header().Ttl
+		if soa, isSoa := rr.(*dns.SOA); isSoa && soa.Minttl < rrTtl {
+			rrTtl = soa.Minttl
+		}
+		if first || rrTtl < ttl {
+			ttl = rrTtl
+			first = false
+		}
+	}
+	if first || ttl == 0 {
+		return 0, false
+	}
+	return ttl, true
+}
+
+func (cache *responseCache) store(req *dns.Msg, msg *dns.Msg) {
+	ttl, ok := responseTtl(msg)
+	if !ok {
+		return
+	}
+	now := time.Now()
+	key := makeCacheKey(req)
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	entry, found := cache.entries[key]
+	if found {
+		cache.lru.MoveToFront(entry.element)
+	} else {
+		entry = &cacheEntry{key: key}
+		entry.element = cache.lru.PushFront(entry)
+		cache.entries[key] = entry
+	}
+	entry.req = req.Copy()
+	entry.msg = msg.Copy()
+	entry.stored = now
+	entry.expires = now.Add(time.Duration(ttl) * time.Second)
+	entry.prefetching = false
+
+	for cache.lru.Len() > cache.config.Size {
+		oldest := cache.lru.Back()
+		cache.lru.Remove(oldest)
+		delete(cache.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// lookup returns a fresh cached answer for req. If the entry is popular
+// and about to expire, prefetch is the request the caller should use to
+// refresh it.
+func (cache *responseCache) lookup(req *dns.Msg) (answer *dns.Msg, prefetch *dns.Msg) {
+	now := time.Now()
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	entry, found := cache.entries[makeCacheKey(req)]
+	if !found || !now.Before(entry.expires) {
+		return nil, nil
+	}
+	cache.lru.MoveToFront(entry.element)
+	entry.hits++
+
+	remaining := entry.expires.Sub(now)
+	if cache.config.Prefetch > 0 && !entry.prefetching &&
+		entry.hits >= cache.config.Prefetchhits &&
+		remaining <= time.Duration(cache.config.Prefetch)*time.Second {
+		entry.prefetching = true
+		prefetch = entry.req.Copy()
+	}
+	age := uint32(now.Sub(entry.stored) / time.Second)
+	return cachedAnswer(req, entry.msg, func(ttl uint32) uint32 {
+		if ttl > age {
+			return ttl - age
+		}
+		return 0
+	}), prefetch
+}
+
+// lookupStale returns an expired answer for req if it is within the
+// configured maximum stale age.
+func (cache *responseCache) lookupStale(req *dns.Msg) (answer *dns.Msg) {
+	now := time.Now()
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	entry, found := cache.entries[makeCacheKey(req)]
+	if !found {
+		return nil
+	}
+	if now.Sub(entry.expires) > time.Duration(cache.config.Stale)*time.Second {
+		return nil
+	}
+	staleTtl := uint32(cache.config.Stalettl)
+	return cachedAnswer(req, entry.msg, func(ttl uint32) uint32 {
+		if ttl > staleTtl {
+			return staleTtl
+		}
+		return ttl
+	})
+}
+
+func (cache *responseCache) prefetchDone(req *dns.Msg) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	if entry, found := cache.entries[makeCacheKey(req)]; found {
+		entry.prefetching = false
+	}
+}
+
+func cachedAnswer(req *dns.Msg, msg *dns.Msg, adjustTtl func(uint32) uint32) (answer *dns.Msg) {
+	answer = msg.Copy()
+	answer.Id = req.Id
+	answer.Question = req.Question
+	if req.IsEdns0() == nil {
+		// the answer may have been cached for a client using EDNS
+		var extra []dns.RR
+		for _, rr := range answer.Extra {
+			if rr.Header().Rrtype != dns.TypeOPT {
+				extra = append(extra, rr)
+			}
+		}
+		answer.Extra = extra
+	}
+	for _, section := range [][]dns.RR{answer.Answer, answer.Ns, answer.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			rr.Header().Ttl = adjustTtl(rr.Header().Ttl)
+		}
+	}
+	return answer
+}
+
+// truncateCached truncates a cached answer to the UDP message size of the
+// client, which may be smaller than that of the request it was cached for.
+func truncateCached(w dns.ResponseWriter, req *dns.Msg, answer *dns.Msg) {
+	if _, ok := w.RemoteAddr().(*net.UDPAddr); !ok {
+		return
+	}
+	size := dns.MinMsgSize
+	if opt := req.IsEdns0(); opt != nil {
+		size = int(opt.UDPSize())
+	}
+	answer.Truncate(size)
+}
+
+// eof
@@ -0,0 +1,215 @@
+//
+// dns64.go
+//
+// Copyright © 2015 Janne Snabb <snabb AT epipe.com>
+//
+// This file is part of Flixproxy.
+//
+// Flixproxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Flixproxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Flixproxy. If not, see <http://www.gnu.org/licenses/>.
+//
+
+package dnsproxy
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+	"github.com/snabb/flixproxy/access"
+)
+
+// Dns64Config defines DNS64 (RFC 6147) synthesis of AAAA records from A
+// records. AAAA records within Exclude are treated as non-existent and
+// A records within Excludev4 are not used for synthesis.
+type Dns64Config struct {
+	Prefix    access.IPNet // /32, /40, /48, /56, /64 or /96 prefix, DNS64 is disabled if not set
+	Exclude   []access.IPNet
+	Excludev4 []access.IPNet
+}
+
+// IPv4-mapped addresses are always excluded (RFC 6147 section 5.1.4).
+var dns64MappedNet = &net.IPNet{
+	IP:   net.ParseIP("::ffff:0:0"),
+	Mask: net.CIDRMask(96, 128),
+}
+
+func (config Dns64Config) enabled() bool {
+	return config.Prefix.IPNet != nil && validDns64Prefix(config.Prefix)
+}
+
+// validDns64Prefix tells if the prefix has one of the lengths defined in
+// RFC 6052 section 2.2.
+func validDns64Prefix(prefix access.IPNet) bool {
+	ones, bits := prefix.Mask.Size()
+	if bits != 8*net.IPv6len {
+		return false
+	}
+	switch ones {
+	case 32, 40, 48, 56, 64, 96:
+		return true
+	}
+	return false
+}
+
+// embedIPv4 places ip4 after the prefix as in RFC 6052 section 2.2. Bits
+// 64 to 71 are skipped unless the prefix is /96.
+func embedIPv4(prefix access.IPNet, ip4 net.IP) net.IP {
+	ip6 := make(net.IP, net.IPv6len)
+	copy(ip6, prefix.IP.To16())
+	ones, _ := prefix.Mask.Size()
+	pos := ones / 8
+	for _, b := range ip4 {
+		if pos == 8 && ones != 96 {
+			pos++
+		}
+		ip6[pos] = b
+		pos++
+	}
+	return ip6
+}
+
+func inIPNets(nets []access.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (config Dns64Config) excludedAAAA(ip net.IP) bool {
+	return dns64MappedNet.Contains(ip) || inIPNets(config.Exclude, ip)
+}
+
+func (config Dns64Config) synthesize(a *dns.A) (aaaa *dns.AAAA) {
+	ip4 := a.A.To4()
+	if ip4 == nil || inIPNets(config.Excludev4, ip4) {
+		return nil
+	}
+	hdr := a.Hdr
+	hdr.Rrtype = dns.TypeAAAA
+	hdr.Rdlength = 0
+	return &dns.AAAA{Hdr: hdr, AAAA: embedIPv4(config.Prefix, ip4)}
+}
+
+// synthesizeRRs returns AAAA records synthesized from the A records in rrs
+// and keeps any CNAME records leading to them.
+func (config Dns64Config) synthesizeRRs(rrs []dns.RR, maxTtl uint32) (answer []dns.RR) {
+	found := false
+	for _, rr := range rrs {
+		switch rr := rr.(type) {
+		case *dns.CNAME:
+			answer = append(answer, rr)
+		case *dns.A:
+			if aaaa := config.synthesize(rr); aaaa != nil {
+				if aaaa.Hdr.Ttl > maxTtl {
+					aaaa.Hdr.Ttl = maxTtl
+				}
+				answer = append(answer, aaaa)
+				found = true
+			}
+		}
+	}
+	if !found {
+		return nil
+	}
+	return answer
+}
+
+func isDns64Question(req *dns.Msg) bool {
+	q := req.Question[0]
+	return q.Qtype == dns.TypeAAAA && q.Qclass == dns.ClassINET &&
+		!req.CheckingDisabled
+}
+
+// usableAAAA returns the answer section without excluded AAAA records and
+// tells if any AAAA records remain.
+func (config Dns64Config) usableAAAA(rrs []dns.RR) (answer []dns.RR, found bool) {
+	for _, rr := range rrs {
+		if aaaa, ok := rr.(*dns.AAAA); ok {
+			if config.excludedAAAA(aaaa.AAAA) {
+				continue
+			}
+			found = true
+		}
+		answer = append(answer, rr)
+	}
+	return answer, found
+}
+
+// negativeTtl returns the TTL for the synthesized records which must not
+// exceed the negative caching time of the AAAA response.
+func negativeTtl(response *dns.Msg) (ttl uint32) {
+	ttl = 600
+	for _, rr := range response.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			ttl = soa.Minttl
+			if soa.Hdr.Ttl < ttl {
+				ttl = soa.Hdr.Ttl
+			}
+		}
+	}
+	return ttl
+}
+
+// synthesizeDns64 replaces a forwarded AAAA response without usable AAAA
+// records with records synthesized from the corresponding A response.
+func (dnsProxy *DNSProxy) synthesizeDns64(req *dns.Msg, response *dns.Msg) *dns.Msg {
+	config := dnsProxy.config.Dns64
+
+	if !config.enabled() || !isDns64Question(req) || response.Rcode != dns.RcodeSuccess {
+		return response
+	}
+	answer, found := config.usableAAAA(response.Answer)
+	if found {
+		response.Answer = answer
+		return response
+	}
+	aReq := req.Copy()
+	aReq.Question[0].Qtype = dns.TypeA
+
+	aResponse := dnsProxy.getCachedReply(aReq)
+	if aResponse == nil {
+		var err error
+		if aResponse, err = dnsProxy.forward(aReq); err != nil {
+			dnsProxy.logger.Warn("dns64 error", "question", questionString(aReq.Question[0]), "err", err)
+			return response
+		}
+	}
+	if aResponse.Rcode != dns.RcodeSuccess {
+		return response
+	}
+	synthesized := config.synthesizeRRs(aResponse.Answer, negativeTtl(response))
+	if synthesized == nil {
+		return response
+	}
+	response.Answer = synthesized
+	response.Ns = nil
+	return response
+}
+
+// synthesizeSpoofedDns64 synthesizes AAAA records from spoofed A records.
+func (dnsProxy *DNSProxy) synthesizeSpoofedDns64(req *dns.Msg, aAnswer []dns.RR) *dns.Msg {
+	config := dnsProxy.config.Dns64
+
+	if !config.enabled() || !isDns64Question(req) {
+		return nil
+	}
+	synthesized := config.synthesizeRRs(aAnswer, ^uint32(0))
+	if synthesized == nil {
+		return nil
+	}
+	return makeAnswerMessage(req, synthesized)
+}
+
+// eof
@@ -0,0 +1,79 @@
+//
+// dns64_test.go
+//
+// Copyright © 2015 Janne Snabb <snabb AT epipe.com>
+//
+// This file is part of Flixproxy.
+//
+// Flixproxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Flixproxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Flixproxy. If not, see <http://www.gnu.org/licenses/>.
+//
+
+package dnsproxy
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/snabb/flixproxy/access"
+)
+
+func mustIPNet(t *testing.T, s string) access.IPNet {
+	_, ipNet, err := net.ParseCIDR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return access.IPNet{IPNet: ipNet}
+}
+
+// examples from RFC 6052 section 2.4
+func TestDns64Synthesize(t *testing.T) {
+	tests := []struct {
+		prefix string
+		aaaa   string
+	}{
+		{"2001:db8::/32", "2001:db8:c000:221::"},
+		{"2001:db8:100::/40", "2001:db8:1c0:2:21::"},
+		{"2001:db8:122::/48", "2001:db8:122:c000:2:2100::"},
+		{"2001:db8:122:300::/56", "2001:db8:122:3c0:0:221::"},
+		{"2001:db8:122:344::/64", "2001:db8:122:344:c0:2:2100:0"},
+		{"2001:db8:122:344::/96", "2001:db8:122:344::192.0.2.33"},
+	}
+	a := &dns.A{
+		Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   net.ParseIP("192.0.2.33"),
+	}
+	for _, test := range tests {
+		config := Dns64Config{Prefix: mustIPNet(t, test.prefix)}
+		if !config.enabled() {
+			t.Errorf("%s: not enabled", test.prefix)
+			continue
+		}
+		aaaa := config.synthesize(a)
+		if aaaa == nil || !aaaa.AAAA.Equal(net.ParseIP(test.aaaa)) {
+			t.Errorf("%s: synthesized %v, expected %s", test.prefix, aaaa, test.aaaa)
+		}
+	}
+}
+
+func TestDns64InvalidPrefix(t *testing.T) {
+	for _, prefix := range []string{"2001:db8::/60", "2001:db8::/128", "192.0.2.0/24"} {
+		config := Dns64Config{Prefix: mustIPNet(t, prefix)}
+		if config.enabled() {
+			t.Errorf("%s: enabled", prefix)
+		}
+	}
+}
+
+// eof
@@ -24,27 +24,49 @@ package dnsproxy
 import (
 	"errors"
 	"math/rand"
+	"net"
 	"strconv"
 	"strings"
 
 	"github.com/miekg/dns"
 	"github.com/ryanuber/go-glob"
 	"github.com/snabb/flixproxy/access"
+	"github.com/snabb/flixproxy/util"
 	"gopkg.in/inconshreveable/log15.v2"
 )
 
 type DNSProxy struct {
-	config Config
-	access access.Checker
-	logger log15.Logger
+	config      Config
+	access      access.Checker
+	chaosAccess access.Checker
+	cache       *responseCache
+	logger      log15.Logger
 }
 
 type Config struct {
-	Id        string
-	Listen    string
-	Acl       string
-	Forwarder string
-	Spoof     rrSlice
+	Id         string
+	Listen     string
+	Acl        string
+	Forwarder  string
+	Spoof      rrSlice
+	Chaos      ChaosConfig
+	Cache      CacheConfig
+	Dohhosts   []string
+	Dns64      Dns64Config
+	Minimalany bool
+}
+
+// Queries for the canary domain are answered with NXDOMAIN to signal that
+// browsers should not enable DNS over HTTPS by default.
+const dohCanaryDomain = "use-application-dns.net."
+
+// ChaosConfig defines the answers to CHAOS class TXT identity queries.
+// Empty values are answered with REFUSED.
+type ChaosConfig struct {
+	Acl      string // defaults to the instance ACL
+	Version  string // version.bind, version.server
+	Hostname string // hostname.bind, id.server
+	Authors  string // authors.bind
 }
 
 type rrSlice struct {
@@ -97,14 +119,19 @@ func (spoof *rrSlice) UnmarshalTOML(d interface{}) (err error) {
 	return spoof.unmarshalAny(spoofString)
 }
 
-func New(config Config, access access.Checker, logger log15.Logger) (dnsProxy *DNSProxy) {
+func New(config Config, access access.Checker, chaosAccess access.Checker, logger log15.Logger) (dnsProxy *DNSProxy) {
 	if config.Id != "" {
 		logger = logger.New("id", config.Id)
 	}
+	if config.Dns64.Prefix.IPNet != nil && !validDns64Prefix(config.Dns64.Prefix) {
+		logger.Crit("invalid dns64 prefix length, dns64 disabled", "prefix", config.Dns64.Prefix.String())
+	}
 	dnsProxy = &DNSProxy{
-		config: config,
-		access: access,
-		logger: logger,
+		config:      config,
+		access:      access,
+		chaosAccess: chaosAccess,
+		cache:       newResponseCache(config.Cache),
+		logger:      logger,
 	}
 	go func() {
 		logger.Info("starting udp listener", "listen", config.Listen)
@@ -134,23 +161,56 @@ func makeAnswerMessage(req *dns.Msg, rr []dns.RR) (m *dns.Msg) {
 	return m
 }
 
-func (dnsProxy *DNSProxy) checkVersionQuestion(req *dns.Msg) (answer *dns.Msg) {
+func (dnsProxy *DNSProxy) chaosText(qname string) (text string, ok bool) {
+	chaos := dnsProxy.config.Chaos
+
+	switch qname {
+	case "version.bind.", "version.server.":
+		return chaos.Version, true
+	case "hostname.bind.", "id.server.":
+		return chaos.Hostname, true
+	case "authors.bind.":
+		return chaos.Authors, true
+	}
+	return "", false
+}
+
+func (dnsProxy *DNSProxy) checkChaosQuestion(req *dns.Msg, addr net.Addr) (answer *dns.Msg) {
 	q := req.Question[0]
-	qname := strings.ToLower(q.Name)
-
-	if q.Qclass == dns.ClassCHAOS && q.Qtype == dns.TypeTXT &&
-		(qname == "version.bind." || qname == "version.server.") {
-
-		rr := dns.RR(&dns.TXT{
-			Hdr: dns.RR_Header{
-				Name:   q.Name,
-				Rrtype: dns.TypeTXT,
-				Class:  dns.ClassCHAOS,
-				Ttl:    3600,
-			},
-			Txt: []string{"Flixproxy"},
-		})
-		return makeAnswerMessage(req, []dns.RR{rr})
+
+	if q.Qclass != dns.ClassCHAOS || q.Qtype != dns.TypeTXT {
+		return nil
+	}
+	text, ok := dnsProxy.chaosText(strings.ToLower(q.Name))
+	if !ok {
+		return nil
+	}
+	if text == "" || !dnsProxy.chaosAccess.AllowedAddr(addr) {
+		m := new(dns.Msg)
+		m.SetRcode(req, dns.RcodeRefused)
+		return m
+	}
+	rr := dns.RR(&dns.TXT{
+		Hdr: dns.RR_Header{
+			Name:   q.Name,
+			Rrtype: dns.TypeTXT,
+			Class:  dns.ClassCHAOS,
+			Ttl:    0,
+		},
+		Txt: []string{text},
+	})
+	return makeAnswerMessage(req, []dns.RR{rr})
+}
+
+func (dnsProxy *DNSProxy) checkDohQuestion(req *dns.Msg) (answer *dns.Msg) {
+	qname := strings.ToLower(req.Question[0].Name)
+
+	if qname == dohCanaryDomain ||
+		util.ManyGlob(dnsProxy.config.Dohhosts, strings.TrimSuffix(qname, ".")) {
+		m := new(dns.Msg)
+		m.SetRcode(req, dns.RcodeNameError)
+		m.RecursionAvailable = true
+		return m
 	}
 	return nil
 }
@@ -208,7 +268,10 @@ func (dnsProxy *DNSProxy) getMessageReply(req *dns.Msg) *dns.Msg {
 		// check if corresponding spoofed A record exists
 		q2 := q
 		q2.Qtype = dns.TypeA
-		if dnsProxy.getQuestionAnswer(q2) != nil {
+		if aAnswer := dnsProxy.getQuestionAnswer(q2); aAnswer != nil {
+			if m := dnsProxy.synthesizeSpoofedDns64(req, aAnswer); m != nil {
+				return m
+			}
 			// return NXDOMAIN
 			// client should retry looking up for TypeA
 			m := new(dns.Msg)
@@ -219,6 +282,49 @@ func (dnsProxy *DNSProxy) getMessageReply(req *dns.Msg) *dns.Msg {
 	return nil
 }
 
+// smallestRRset returns the RRset with the least records.
+func smallestRRset(rr []dns.RR) (rrset []dns.RR) {
+	sets := make(map[uint16][]dns.RR)
+	for _, r := range rr {
+		t := r.Header().Rrtype
+		sets[t] = append(sets[t], r)
+	}
+	var best uint16
+	for t, set := range sets {
+		if rrset == nil || len(set) < len(rrset) || (len(set) == len(rrset) && t < best) {
+			rrset = set
+			best = t
+		}
+	}
+	return rrset
+}
+
+// getMinimalAnyReply answers ANY queries over UDP with a minimal answer
+// according to RFC 8482 to avoid amplification.
+func (dnsProxy *DNSProxy) getMinimalAnyReply(req *dns.Msg, addr net.Addr) *dns.Msg {
+	q := req.Question[0]
+
+	if !dnsProxy.config.Minimalany || q.Qtype != dns.TypeANY {
+		return nil
+	}
+	if _, udp := addr.(*net.UDPAddr); !udp {
+		return nil
+	}
+	if answer := dnsProxy.getQuestionAnswer(q); answer != nil {
+		return makeAnswerMessage(req, smallestRRset(answer))
+	}
+	rr := dns.RR(&dns.HINFO{
+		Hdr: dns.RR_Header{
+			Name:   q.Name,
+			Rrtype: dns.TypeHINFO,
+			Class:  q.Qclass,
+			Ttl:    3600,
+		},
+		Cpu: "RFC8482",
+	})
+	return makeAnswerMessage(req, []dns.RR{rr})
+}
+
 func questionString(q dns.Question) string {
 	c, ok := dns.ClassToString[q.Qclass]
 	if !ok {
@@ -231,6 +337,43 @@ func questionString(q dns.Question) string {
 	return c + "·" + t + "·" + q.Name
 }
 
+func (dnsProxy *DNSProxy) forward(req *dns.Msg) (response *dns.Msg, err error) {
+	c := new(dns.Client)
+	response, _, err = c.Exchange(req, dnsProxy.config.Forwarder)
+	if err == nil && dnsProxy.cache != nil {
+		dnsProxy.cache.store(req, response)
+	}
+	return response, err
+}
+
+func (dnsProxy *DNSProxy) prefetch(req *dns.Msg, logger log15.Logger) {
+	defer dnsProxy.cache.prefetchDone(req)
+
+	if _, err := dnsProxy.forward(req); err != nil {
+		logger.Warn("prefetch error", "question", questionString(req.Question[0]), "err", err)
+	} else {
+		logger.Debug("prefetched", "question", questionString(req.Question[0]))
+	}
+}
+
+func (dnsProxy *DNSProxy) getCachedReply(req *dns.Msg) *dns.Msg {
+	if dnsProxy.cache == nil {
+		return nil
+	}
+	answer, prefetch := dnsProxy.cache.lookup(req)
+	if prefetch != nil {
+		go dnsProxy.prefetch(prefetch, dnsProxy.logger)
+	}
+	return answer
+}
+
+func (dnsProxy *DNSProxy) getStaleReply(req *dns.Msg) *dns.Msg {
+	if dnsProxy.cache == nil {
+		return nil
+	}
+	return dnsProxy.cache.lookupStale(req)
+}
+
 func (dnsProxy *DNSProxy) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 	var response *dns.Msg
 	var err error
@@ -244,24 +387,43 @@ func (dnsProxy *DNSProxy) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 		logger.Error("wrong number of questions", "n", len(req.Question))
 		response = new(dns.Msg)
 		response.SetRcode(req, dns.RcodeFormatError)
-	} else if response = dnsProxy.checkVersionQuestion(req); response != nil {
-		logger.Debug("local answer", "question", questionString(req.Question[0]))
+	} else if response = dnsProxy.checkChaosQuestion(req, w.RemoteAddr()); response != nil {
+		logger.Debug("chaos answer", "question", questionString(req.Question[0]),
+			"rcode", dns.RcodeToString[response.Rcode])
 	} else if !dnsProxy.access.AllowedAddr(w.RemoteAddr()) {
 		logger.Warn("access denied", "question", questionString(req.Question[0]))
 		response = new(dns.Msg)
 		response.SetRcode(req, dns.RcodeRefused)
+	} else if response = dnsProxy.checkDohQuestion(req); response != nil {
+		logger.Info("doh blocked", "question", questionString(req.Question[0]))
+	} else if response = dnsProxy.getMinimalAnyReply(req, w.RemoteAddr()); response != nil {
+		logger.Debug("minimal any answer", "question", questionString(req.Question[0]))
 	} else if response = dnsProxy.getMessageReply(req); response != nil {
 		logger.Debug("local answer", "question", questionString(req.Question[0]))
+	} else if response = dnsProxy.getCachedReply(req); response != nil {
+		logger.Debug("cached answer", "question", questionString(req.Question[0]))
+		response = dnsProxy.synthesizeDns64(req, response)
+		truncateCached(w, req, response)
 	} else {
-		c := new(dns.Client)
-		response, _, err = c.Exchange(req, dnsProxy.config.Forwarder)
-		if err == nil {
+		staleAnswer := false
+		response, err = dnsProxy.forward(req)
+		if err == nil && response.Rcode != dns.RcodeServerFailure {
+			logger.Debug("remote answer", "question", questionString(req.Question[0]))
+		} else if stale := dnsProxy.getStaleReply(req); stale != nil {
+			logger.Warn("stale answer", "question", questionString(req.Question[0]), "err", err)
+			response = stale
+			staleAnswer = true
+		} else if err == nil {
 			logger.Debug("remote answer", "question", questionString(req.Question[0]))
 		} else {
 			logger.Error("remote error", "question", questionString(req.Question[0]), "err", err)
 			response = new(dns.Msg)
 			response.SetRcode(req, dns.RcodeServerFailure)
 		}
+		response = dnsProxy.synthesizeDns64(req, response)
+		if staleAnswer {
+			truncateCached(w, req, response)
+		}
 	}
 	w.WriteMsg(response)
 }
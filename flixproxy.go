@@ -34,6 +34,7 @@ import (
 
 	"github.com/ogier/pflag"
 	"github.com/snabb/flixproxy/access"
+	"github.com/snabb/flixproxy/accesslog"
 	"github.com/snabb/flixproxy/dnsproxy"
 	"github.com/snabb/flixproxy/httpproxy"
 	"github.com/snabb/flixproxy/tlsproxy"
@@ -99,16 +100,23 @@ func main() {
 		Stop()
 	}
 	for _, proxyConfig := range config.DNS {
+		chaosAcl := proxyConfig.Chaos.Acl
+		if chaosAcl == "" {
+			chaosAcl = proxyConfig.Acl
+		}
 		proxies = append(proxies,
-			dnsproxy.New(proxyConfig, config.Acl.GetAcl(proxyConfig.Acl), logger.New("s", "DNS")))
+			dnsproxy.New(proxyConfig, config.Acl.GetAcl(proxyConfig.Acl),
+				config.Acl.GetAcl(chaosAcl), logger.New("s", "DNS")))
 	}
 	for _, proxyConfig := range config.HTTP {
 		proxies = append(proxies,
-			httpproxy.New(proxyConfig, config.Acl.GetAcl(proxyConfig.Acl), logger.New("s", "HTTP")))
+			httpproxy.New(proxyConfig, config.Acl.GetAcl(proxyConfig.Acl),
+				config.Acl.GetAcl(proxyConfig.Proxyacl), logger.New("s", "HTTP")))
 	}
 	for _, proxyConfig := range config.TLS {
 		proxies = append(proxies,
-			tlsproxy.New(proxyConfig, config.Acl.GetAcl(proxyConfig.Acl), logger.New("s", "TLS")))
+			tlsproxy.New(proxyConfig, config.Acl.GetAcl(proxyConfig.Acl),
+				config.Acl.GetAcl(proxyConfig.Proxyacl), logger.New("s", "TLS")))
 	}
 
 	sigCexit := make(chan os.Signal, 1)
@@ -127,6 +135,9 @@ MAINLOOP:
 			break MAINLOOP
 		case <-sigChup:
 			setupLogging(logger, config.Logging)
+			if err := accesslog.ReopenAll(); err != nil {
+				logger.Error("error reopening access logs", "err", err)
+			}
 			logger.Debug("reopened logs")
 		}
 	}
@@ -9,7 +9,8 @@ require (
 	github.com/miekg/dns v1.1.50
 	github.com/ogier/pflag v0.0.1
 	github.com/ryanuber/go-glob v1.0.0
-	golang.org/x/net v0.7.0 // indirect
+	golang.org/x/crypto v0.5.0
+	golang.org/x/net v0.7.0
 	golang.org/x/tools v0.6.0 // indirect
 	gopkg.in/inconshreveable/log15.v2 v2.16.0
 	gopkg.in/yaml.v2 v2.4.0
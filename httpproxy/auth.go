@@ -0,0 +1,199 @@
+//
+// auth.go
+//
+// Copyright © 2015 Janne Snabb <snabb AT epipe.com>
+//
+// This file is part of Flixproxy.
+//
+// Flixproxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Flixproxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Flixproxy. If not, see <http://www.gnu.org/licenses/>.
+//
+
+package httpproxy
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/snabb/flixproxy/accesslog"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// AuthConfig defines proxy authentication with the Proxy-Authorization
+// header. Clients not allowed by the ACL are accepted if they send valid
+// credentials.
+type AuthConfig struct {
+	Htpasswd string   // htpasswd file with bcrypt password hashes
+	Tokens   []string // static bearer tokens
+	Realm    string
+}
+
+// authenticator checks proxy credentials. Successfully verified Basic
+// credentials are remembered as bcrypt is slow by design.
+type authenticator struct {
+	config   AuthConfig
+	users    map[string][]byte
+	mutex    sync.Mutex
+	verified map[[sha256.Size]byte]string
+}
+
+const defaultRealm = "Flixproxy"
+
+func loadHtpasswd(fileName string) (users map[string][]byte, err error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	users = make(map[string][]byte)
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.IndexByte(line, ':')
+		if i == -1 || !strings.HasPrefix(line[i+1:], "$2") {
+			return nil, errors.New("line " + strconv.Itoa(lineNumber) + ": expected user:bcrypt-hash")
+		}
+		users[line[:i]] = []byte(line[i+1:])
+	}
+	return users, scanner.Err()
+}
+
+// newAuthenticator returns nil if authentication is not configured.
+func newAuthenticator(config AuthConfig) (auth *authenticator, err error) {
+	if config.Htpasswd == "" && len(config.Tokens) == 0 {
+		return nil, nil
+	}
+	if config.Realm == "" {
+		config.Realm = defaultRealm
+	}
+	auth = &authenticator{
+		config:   config,
+		verified: make(map[[sha256.Size]byte]string),
+	}
+	if config.Htpasswd != "" {
+		if auth.users, err = loadHtpasswd(config.Htpasswd); err != nil {
+			return nil, err
+		}
+	}
+	return auth, nil
+}
+
+// challenges returns the Proxy-Authenticate header fields.
+func (auth *authenticator) challenges() (fields []string) {
+	realm := strconv.Quote(auth.config.Realm)
+	if auth.users != nil {
+		fields = append(fields, "Proxy-Authenticate: Basic realm="+realm+", charset=\"UTF-8\"")
+	}
+	if len(auth.config.Tokens) != 0 {
+		fields = append(fields, "Proxy-Authenticate: Bearer realm="+realm)
+	}
+	return fields
+}
+
+func (auth *authenticator) checkBasic(credentials string) (user string, ok bool) {
+	key := sha256.Sum256([]byte(credentials))
+	auth.mutex.Lock()
+	user, ok = auth.verified[key]
+	auth.mutex.Unlock()
+	if ok {
+		return user, true
+	}
+	decoded, err := base64.StdEncoding.DecodeString(credentials)
+	if err != nil {
+		return "", false
+	}
+	i := strings.IndexByte(string(decoded), ':')
+	if i == -1 {
+		return "", false
+	}
+	user, password := string(decoded[:i]), decoded[i+1:]
+	hash, found := auth.users[user]
+	if !found || bcrypt.CompareHashAndPassword(hash, password) != nil {
+		return "", false
+	}
+	auth.mutex.Lock()
+	auth.verified[key] = user
+	auth.mutex.Unlock()
+	return user, true
+}
+
+func (auth *authenticator) checkBearer(token string) (user string, ok bool) {
+	for i, t := range auth.config.Tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			return "token" + strconv.Itoa(i+1), true
+		}
+	}
+	return "", false
+}
+
+// authenticate checks the value of a Proxy-Authorization header field.
+func (auth *authenticator) authenticate(value string) (user string, ok bool) {
+	i := strings.IndexByte(value, ' ')
+	if i == -1 {
+		return "", false
+	}
+	scheme, credentials := value[:i], strings.TrimSpace(value[i+1:])
+	switch {
+	case strings.EqualFold(scheme, "Basic") && auth.users != nil:
+		return auth.checkBasic(credentials)
+	case strings.EqualFold(scheme, "Bearer"):
+		return auth.checkBearer(credentials)
+	}
+	return "", false
+}
+
+// checkAuth removes the proxy credentials from the request and sends a 407
+// response if they are required but missing or invalid.
+func (httpProxy *HTTPProxy) checkAuth(w io.Writer, head *requestHead, required bool,
+	entry *accesslog.Entry, logger log15.Logger) (allowed bool) {
+
+	auth := httpProxy.auth
+	if auth == nil {
+		return true
+	}
+	field := head.getField("proxy-authorization")
+	head.removeFields("proxy-authorization")
+	if !required {
+		return true
+	}
+	if field != nil {
+		if user, ok := auth.authenticate(field.value); ok {
+			logger.Debug("authenticated", "user", user)
+			entry.User = user
+			return true
+		}
+		logger.Warn("invalid proxy credentials")
+	} else {
+		logger.Info("proxy authentication required")
+	}
+	httpProxy.writeErrorFields(w, entry, http.StatusProxyAuthRequired, "authentication required", auth.challenges())
+	return false
+}
+
+// eof
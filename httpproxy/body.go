@@ -0,0 +1,208 @@
+//
+// body.go
+//
+// Copyright © 2015 Janne Snabb <snabb AT epipe.com>
+//
+// This file is part of Flixproxy.
+//
+// Flixproxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Flixproxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Flixproxy. If not, see <http://www.gnu.org/licenses/>.
+//
+
+package httpproxy
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+)
+
+var (
+	errBadContentLength    = errors.New("invalid Content-Length")
+	errBadTransferEncoding = errors.New("unsupported Transfer-Encoding")
+	errBadChunk            = errors.New("malformed chunked encoding")
+)
+
+const maxChunkLine = 4096
+
+type bodyType int
+
+const (
+	bodyNone    bodyType = iota
+	bodyLength           // Content-Length bytes
+	bodyChunked          // chunked transfer coding
+	bodyClose            // until the connection is closed
+)
+
+type bodyFraming struct {
+	bodyType bodyType
+	length   int64
+}
+
+// isChunked tells if chunked is the final transfer coding.
+func isChunked(head *messageHead) (chunked bool, present bool) {
+	var codings []string
+	for _, field := range head.fields {
+		if field.name == "transfer-encoding" {
+			for _, coding := range strings.Split(field.value, ",") {
+				if coding = strings.TrimSpace(coding); coding != "" {
+					codings = append(codings, coding)
+				}
+			}
+		}
+	}
+	if len(codings) == 0 {
+		return false, false
+	}
+	return strings.EqualFold(codings[len(codings)-1], "chunked"), true
+}
+
+func contentLength(head *messageHead) (length int64, present bool, err error) {
+	for _, field := range head.fields {
+		if field.name != "content-length" {
+			continue
+		}
+		for _, value := range strings.Split(field.value, ",") {
+			n, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+			if err != nil || n < 0 || (present && n != length) {
+				return 0, false, errBadContentLength
+			}
+			length = n
+			present = true
+		}
+	}
+	return length, present, nil
+}
+
+// requestFraming determines the length of the request body (RFC 9112
+// section 6.3).
+func requestFraming(head *requestHead) (framing bodyFraming, err error) {
+	chunked, present := isChunked(&head.messageHead)
+	if present {
+		if !chunked || head.getField("content-length") != nil {
+			return framing, errBadTransferEncoding
+		}
+		return bodyFraming{bodyType: bodyChunked}, nil
+	}
+	length, present, err := contentLength(&head.messageHead)
+	if err != nil {
+		return framing, err
+	}
+	if present && length > 0 {
+		return bodyFraming{bodyType: bodyLength, length: length}, nil
+	}
+	return bodyFraming{bodyType: bodyNone}, nil
+}
+
+// responseFraming determines the length of the response body to the
+// request with the given method.
+func responseFraming(method string, head *responseHead) (framing bodyFraming, err error) {
+	if method == "HEAD" || head.status/100 == 1 ||
+		head.status == 204 || head.status == 304 {
+		return bodyFraming{bodyType: bodyNone}, nil
+	}
+	chunked, present := isChunked(&head.messageHead)
+	if present {
+		if chunked {
+			return bodyFraming{bodyType: bodyChunked}, nil
+		}
+		return bodyFraming{bodyType: bodyClose}, nil
+	}
+	length, present, err := contentLength(&head.messageHead)
+	if err != nil {
+		return framing, err
+	}
+	if present {
+		if length == 0 {
+			return bodyFraming{bodyType: bodyNone}, nil
+		}
+		return bodyFraming{bodyType: bodyLength, length: length}, nil
+	}
+	return bodyFraming{bodyType: bodyClose}, nil
+}
+
+// copyChunked copies a chunked body including the trailer section.
+func copyChunked(dst io.Writer, src *bufio.Reader) (written int64, err error) {
+	for {
+		line, err := readLine(src, maxChunkLine)
+		if err != nil {
+			return written, err
+		}
+		sizeString := trimLineEnd(line)
+		if i := strings.IndexByte(sizeString, ';'); i != -1 {
+			sizeString = sizeString[:i]
+		}
+		size, err := strconv.ParseInt(strings.TrimSpace(sizeString), 16, 64)
+		if err != nil || size < 0 {
+			return written, errBadChunk
+		}
+		n, err := io.WriteString(dst, line)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+		if size == 0 {
+			break
+		}
+		// chunk data followed by CRLF
+		n64, err := io.CopyN(dst, src, size)
+		written += n64
+		if err != nil {
+			return written, err
+		}
+		line, err = readLine(src, maxChunkLine)
+		if err != nil {
+			return written, err
+		}
+		if trimLineEnd(line) != "" {
+			return written, errBadChunk
+		}
+		n, err = io.WriteString(dst, line)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+	// trailer section
+	for {
+		line, err := readLine(src, maxChunkLine)
+		if err != nil {
+			return written, err
+		}
+		n, err := io.WriteString(dst, line)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+		if trimLineEnd(line) == "" {
+			return written, nil
+		}
+	}
+}
+
+// copyBody copies a message body with the given framing.
+func copyBody(dst io.Writer, src *bufio.Reader, framing bodyFraming) (written int64, err error) {
+	switch framing.bodyType {
+	case bodyLength:
+		return io.CopyN(dst, src, framing.length)
+	case bodyChunked:
+		return copyChunked(dst, src)
+	case bodyClose:
+		return io.Copy(dst, src)
+	}
+	return 0, nil
+}
+
+// eof
@@ -0,0 +1,649 @@
+//
+// cache.go
+//
+// Copyright © 2015 Janne Snabb <snabb AT epipe.com>
+//
+// This file is part of Flixproxy.
+//
+// Flixproxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Flixproxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Flixproxy. If not, see <http://www.gnu.org/licenses/>.
+//
+
+package httpproxy
+
+import (
+	"bufio"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/snabb/flixproxy/accesslog"
+	"github.com/snabb/flixproxy/util"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// CacheConfig defines the on-disk cache for responses from the upstreams
+// matching Hosts. Responses are cached in request aware mode only.
+type CacheConfig struct {
+	Hosts     []string // glob patterns for matching host:port
+	Directory string
+	Size      int64 // maximum total size of cached objects (bytes)
+	Maxobject int64 // maximum size of one object (bytes), Size if not set
+}
+
+// cache statuses for the access log
+const (
+	cacheHit         = "HIT"
+	cacheMiss        = "MISS"
+	cacheRevalidated = "REVALIDATED"
+	cacheBypass      = "BYPASS"
+)
+
+// cacheStatusField returns the Cache-Status header value (RFC 9211).
+func cacheStatusField(status string) string {
+	switch status {
+	case cacheHit:
+		return "Flixproxy; hit"
+	case cacheRevalidated:
+		return "Flixproxy; fwd=stale; fwd-status=304"
+	case cacheMiss:
+		return "Flixproxy; fwd=miss"
+	}
+	return "Flixproxy; fwd=bypass"
+}
+
+// maximum heuristic freshness lifetime
+const heuristicLifetimeMax = 24 * time.Hour
+
+// cacheMeta describes a cached response. It is stored in a .meta file
+// next to the .data file holding the response head and body as received.
+type cacheMeta struct {
+	Key          string
+	Stored       time.Time
+	Expires      time.Time
+	InitialAge   int64 // Age of the response when it was received (s)
+	Etag         string
+	LastModified string
+	Vary         map[string]string // request header fields selecting the response
+	Size         int64
+}
+
+type cacheObject struct {
+	meta    cacheMeta
+	element *list.Element
+}
+
+type diskCache struct {
+	config  CacheConfig
+	mutex   sync.Mutex
+	objects map[string]*cacheObject
+	lru     *list.List
+	total   int64
+	logger  log15.Logger
+}
+
+func cacheKey(hostname string, target string) string {
+	return strings.ToLower(hostname) + " " + target
+}
+
+// newDiskCache returns nil if the cache is not configured. Objects stored
+// by earlier runs are loaded from the directory.
+func newDiskCache(config CacheConfig, logger log15.Logger) (cache *diskCache, err error) {
+	if config.Directory == "" || config.Size <= 0 {
+		return nil, nil
+	}
+	if config.Maxobject <= 0 || config.Maxobject > config.Size {
+		config.Maxobject = config.Size
+	}
+	if err = os.MkdirAll(config.Directory, 0755); err != nil {
+		return nil, err
+	}
+	cache = &diskCache{
+		config:  config,
+		objects: make(map[string]*cacheObject),
+		lru:     list.New(),
+		logger:  logger.New("cache", config.Directory),
+	}
+	return cache, cache.load()
+}
+
+func (cache *diskCache) fileName(key string, ext string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(cache.config.Directory, hex.EncodeToString(sum[:])+ext)
+}
+
+func (cache *diskCache) load() (err error) {
+	files, err := ioutil.ReadDir(cache.config.Directory)
+	if err != nil {
+		return err
+	}
+	var metas []cacheMeta
+	var dataFiles []string
+	for _, file := range files {
+		fileName := filepath.Join(cache.config.Directory, file.Name())
+		switch filepath.Ext(file.Name()) {
+		case ".tmp":
+			os.Remove(fileName)
+		case ".data":
+			dataFiles = append(dataFiles, fileName)
+		case ".meta":
+			var meta cacheMeta
+			text, err := ioutil.ReadFile(fileName)
+			if err == nil {
+				err = json.Unmarshal(text, &meta)
+			}
+			if err != nil || cache.fileName(meta.Key, ".meta") != fileName {
+				cache.logger.Warn("removing invalid cache file", "file", fileName, "err", err)
+				os.Remove(fileName)
+				os.Remove(strings.TrimSuffix(fileName, ".meta") + ".data")
+				continue
+			}
+			metas = append(metas, meta)
+		}
+	}
+	sort.Slice(metas, func(i, j int) bool { return metas[i].Stored.Before(metas[j].Stored) })
+	for _, meta := range metas {
+		info, err := os.Stat(cache.fileName(meta.Key, ".data"))
+		if err != nil || info.Size() != meta.Size {
+			os.Remove(cache.fileName(meta.Key, ".meta"))
+			os.Remove(cache.fileName(meta.Key, ".data"))
+			continue
+		}
+		object := &cacheObject{meta: meta}
+		object.element = cache.lru.PushFront(object)
+		cache.objects[meta.Key] = object
+		cache.total += meta.Size
+	}
+	// data files without metadata are left by a failure in commit
+	loaded := make(map[string]bool)
+	for key := range cache.objects {
+		loaded[cache.fileName(key, ".data")] = true
+	}
+	for _, fileName := range dataFiles {
+		// those of removed objects are already gone
+		if !loaded[fileName] && os.Remove(fileName) == nil {
+			cache.logger.Warn("removed orphaned cache file", "file", fileName)
+		}
+	}
+	cache.mutex.Lock()
+	cache.evict()
+	cache.mutex.Unlock()
+	cache.logger.Info("cache loaded", "objects", len(cache.objects), "size", cache.total)
+	return nil
+}
+
+// evict removes the least recently used objects until the cache fits in
+// its size. The caller must hold the mutex.
+func (cache *diskCache) evict() {
+	for cache.total > cache.config.Size {
+		oldest := cache.lru.Back()
+		cache.removeObject(oldest.Value.(*cacheObject))
+	}
+}
+
+func (cache *diskCache) removeObject(object *cacheObject) {
+	cache.lru.Remove(object.element)
+	delete(cache.objects, object.meta.Key)
+	cache.total -= object.meta.Size
+	os.Remove(cache.fileName(object.meta.Key, ".meta"))
+	os.Remove(cache.fileName(object.meta.Key, ".data"))
+}
+
+// lookup returns the cached object for the request and its data file
+// which the caller must close.
+func (cache *diskCache) lookup(key string, head *requestHead) (meta *cacheMeta, file *os.File) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	object, found := cache.objects[key]
+	if !found {
+		return nil, nil
+	}
+	for name, value := range object.meta.Vary {
+		requestValue := ""
+		if field := head.getField(name); field != nil {
+			requestValue = field.value
+		}
+		if requestValue != value {
+			return nil, nil
+		}
+	}
+	file, err := os.Open(cache.fileName(key, ".data"))
+	if err != nil {
+		cache.logger.Error("error opening cache file", "err", err)
+		cache.removeObject(object)
+		return nil, nil
+	}
+	cache.lru.MoveToFront(object.element)
+	metaCopy := object.meta
+	return &metaCopy, file
+}
+
+func (cache *diskCache) writeMeta(meta *cacheMeta) (err error) {
+	text, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	tmpName := cache.fileName(meta.Key, "."+newRequestId()+".tmp")
+	if err = ioutil.WriteFile(tmpName, text, 0644); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	return os.Rename(tmpName, cache.fileName(meta.Key, ".meta"))
+}
+
+// refresh updates the freshness of meta and the cached object after a
+// successful revalidation.
+func (cache *diskCache) refresh(meta *cacheMeta, response *responseHead) {
+	now := time.Now()
+	lifetime, initialAge, ok := freshnessLifetime(response, now)
+	if !ok {
+		lifetime = meta.Expires.Sub(meta.Stored) + time.Duration(meta.InitialAge)*time.Second
+	}
+	meta.Stored = now
+	meta.InitialAge = initialAge
+	meta.Expires = now.Add(lifetime - time.Duration(initialAge)*time.Second)
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	object, found := cache.objects[meta.Key]
+	if !found {
+		return
+	}
+	object.meta.Stored = meta.Stored
+	object.meta.InitialAge = meta.InitialAge
+	object.meta.Expires = meta.Expires
+	if err := cache.writeMeta(&object.meta); err != nil {
+		cache.logger.Error("error writing cache file", "err", err)
+	}
+}
+
+// cacheWriter stores a response while it is forwarded. Writes never fail
+// so that errors or oversized objects do not affect the client.
+type cacheWriter struct {
+	cache  *diskCache
+	meta   cacheMeta
+	file   *os.File
+	failed bool
+}
+
+// newWriter starts storing a response. It returns nil if the response is
+// not cacheable.
+func (cache *diskCache) newWriter(key string, head *requestHead, response *responseHead,
+	framing bodyFraming) *cacheWriter {
+
+	meta, ok := cacheableResponse(head, response, framing, time.Now())
+	if !ok {
+		return nil
+	}
+	meta.Key = key
+	file, err := ioutil.TempFile(cache.config.Directory, "object.*.tmp")
+	if err != nil {
+		cache.logger.Error("error creating cache file", "err", err)
+		return nil
+	}
+	file.Chmod(0644)
+	w := &cacheWriter{cache: cache, meta: meta, file: file}
+	w.Write(response.bytes())
+	return w
+}
+
+func (w *cacheWriter) Write(b []byte) (n int, err error) {
+	if w.failed {
+		return len(b), nil
+	}
+	if w.meta.Size+int64(len(b)) > w.cache.config.Maxobject {
+		w.failed = true
+		return len(b), nil
+	}
+	n, err = w.file.Write(b)
+	w.meta.Size += int64(n)
+	if err != nil {
+		w.cache.logger.Error("error writing cache file", "err", err)
+		w.failed = true
+	}
+	return len(b), nil
+}
+
+func (w *cacheWriter) abort() {
+	w.file.Close()
+	os.Remove(w.file.Name())
+}
+
+// commit adds the stored response to the cache replacing any earlier
+// version.
+func (w *cacheWriter) commit() {
+	if w.failed {
+		w.abort()
+		return
+	}
+	cache := w.cache
+	if err := w.file.Close(); err != nil {
+		cache.logger.Error("error writing cache file", "err", err)
+		os.Remove(w.file.Name())
+		return
+	}
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	if old, found := cache.objects[w.meta.Key]; found {
+		cache.lru.Remove(old.element)
+		delete(cache.objects, old.meta.Key)
+		cache.total -= old.meta.Size
+	}
+	err := os.Rename(w.file.Name(), cache.fileName(w.meta.Key, ".data"))
+	if err == nil {
+		err = cache.writeMeta(&w.meta)
+	}
+	if err != nil {
+		cache.logger.Error("error writing cache file", "err", err)
+		os.Remove(w.file.Name())
+		os.Remove(cache.fileName(w.meta.Key, ".data"))
+		return
+	}
+	object := &cacheObject{meta: w.meta}
+	object.element = cache.lru.PushFront(object)
+	cache.objects[w.meta.Key] = object
+	cache.total += w.meta.Size
+	cache.evict()
+}
+
+// cacheControl returns the Cache-Control directives with lower case names.
+func cacheControl(head *messageHead) (directives map[string]string) {
+	directives = make(map[string]string)
+	for _, field := range head.fields {
+		if field.name != "cache-control" {
+			continue
+		}
+		for _, directive := range strings.Split(field.value, ",") {
+			directive = strings.TrimSpace(directive)
+			if directive == "" {
+				continue
+			}
+			name, value := directive, ""
+			if i := strings.IndexByte(directive, '='); i != -1 {
+				name, value = directive[:i], strings.Trim(directive[i+1:], "\"")
+			}
+			directives[strings.ToLower(name)] = value
+		}
+	}
+	return directives
+}
+
+func fieldValue(head *messageHead, name string) string {
+	if field := head.getField(name); field != nil {
+		return field.value
+	}
+	return ""
+}
+
+// cacheableRequest tells if the response to the request may be served
+// from or stored in the cache.
+func cacheableRequest(head *requestHead, framing bodyFraming) bool {
+	if head.method != "GET" || head.proto != "HTTP/1.1" || framing.bodyType != bodyNone {
+		return false
+	}
+	for _, name := range []string{"authorization", "range", "if-none-match",
+		"if-modified-since", "if-match", "if-unmodified-since", "if-range"} {
+		if head.getField(name) != nil {
+			return false
+		}
+	}
+	_, noStore := cacheControl(&head.messageHead)["no-store"]
+	return !noStore
+}
+
+// requestNoCache tells if the client wants the cached response to be
+// revalidated.
+func requestNoCache(head *requestHead) bool {
+	directives := cacheControl(&head.messageHead)
+	if _, found := directives["no-cache"]; found {
+		return true
+	}
+	if maxAge, found := directives["max-age"]; found && maxAge == "0" {
+		return true
+	}
+	return head.hasToken("pragma", "no-cache")
+}
+
+// freshnessLifetime returns the freshness lifetime of the response
+// (RFC 9111 section 4.2.1) and its Age. Ok is false if the response has
+// no explicit or heuristic lifetime.
+func freshnessLifetime(response *responseHead, now time.Time) (lifetime time.Duration, age int64, ok bool) {
+	head := &response.messageHead
+	if a, err := strconv.ParseInt(fieldValue(head, "age"), 10, 64); err == nil && a > 0 {
+		age = a
+	}
+	directives := cacheControl(head)
+	for _, name := range []string{"s-maxage", "max-age"} {
+		if value, found := directives[name]; found {
+			seconds, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || seconds < 0 {
+				return 0, age, true
+			}
+			return time.Duration(seconds) * time.Second, age, true
+		}
+	}
+	date, err := http.ParseTime(fieldValue(head, "date"))
+	if err != nil {
+		date = now
+	}
+	if expiresValue := fieldValue(head, "expires"); expiresValue != "" {
+		expires, err := http.ParseTime(expiresValue)
+		if err != nil || expires.Before(date) {
+			return 0, age, true
+		}
+		return expires.Sub(date), age, true
+	}
+	if lastModified, err := http.ParseTime(fieldValue(head, "last-modified")); err == nil && lastModified.Before(date) {
+		lifetime = date.Sub(lastModified) / 10
+		if lifetime > heuristicLifetimeMax {
+			lifetime = heuristicLifetimeMax
+		}
+		return lifetime, age, true
+	}
+	return 0, age, false
+}
+
+// cacheableResponse returns the metadata for storing the response if it
+// may be cached by a shared cache.
+func cacheableResponse(head *requestHead, response *responseHead, framing bodyFraming,
+	now time.Time) (meta cacheMeta, ok bool) {
+
+	if response.status != http.StatusOK || framing.bodyType == bodyClose {
+		return meta, false
+	}
+	directives := cacheControl(&response.messageHead)
+	for _, name := range []string{"no-store", "private"} {
+		if _, found := directives[name]; found {
+			return meta, false
+		}
+	}
+	if response.getField("set-cookie") != nil {
+		return meta, false
+	}
+	meta.Vary = make(map[string]string)
+	for _, field := range response.fields {
+		if field.name != "vary" {
+			continue
+		}
+		for _, name := range strings.Split(field.value, ",") {
+			name = strings.ToLower(strings.TrimSpace(name))
+			if name == "*" {
+				return meta, false
+			}
+			if name != "" {
+				meta.Vary[name] = fieldValue(&head.messageHead, name)
+			}
+		}
+	}
+	meta.Etag = fieldValue(&response.messageHead, "etag")
+	meta.LastModified = fieldValue(&response.messageHead, "last-modified")
+
+	lifetime, age, found := freshnessLifetime(response, now)
+	if _, noCache := directives["no-cache"]; noCache {
+		lifetime = 0
+	}
+	if (!found || lifetime <= time.Duration(age)*time.Second) && meta.Etag == "" && meta.LastModified == "" {
+		// neither fresh nor revalidatable
+		return meta, false
+	}
+	meta.Stored = now
+	meta.InitialAge = age
+	meta.Expires = now.Add(lifetime - time.Duration(age)*time.Second)
+	return meta, true
+}
+
+func (meta *cacheMeta) fresh(now time.Time) bool {
+	return now.Before(meta.Expires)
+}
+
+// age returns the value of the Age header field for the cached response.
+func (meta *cacheMeta) age(now time.Time) int64 {
+	return meta.InitialAge + int64(now.Sub(meta.Stored)/time.Second)
+}
+
+// addConditional makes the request conditional on the validators of the
+// cached response. It returns false if there are no validators.
+func (meta *cacheMeta) addConditional(head *requestHead) bool {
+	if meta.Etag == "" && meta.LastModified == "" {
+		return false
+	}
+	if meta.Etag != "" {
+		head.setField("if-none-match", "If-None-Match", meta.Etag)
+	}
+	if meta.LastModified != "" {
+		head.setField("if-modified-since", "If-Modified-Since", meta.LastModified)
+	}
+	return true
+}
+
+// cacheRequest tracks the caching of one request in a session.
+type cacheRequest struct {
+	key  string
+	meta *cacheMeta // stale cached response being revalidated
+	file *os.File
+}
+
+func (c *cacheRequest) close() {
+	if c.file != nil {
+		c.file.Close()
+	}
+}
+
+// lookupCache determines how the request is cached. Served is true if the
+// response was sent from the cache.
+func (s *session) lookupCache(hostname string, head *requestHead, framing bodyFraming,
+	entry *accesslog.Entry, logger log15.Logger) (c *cacheRequest, served bool, keepAlive bool) {
+
+	httpProxy := s.httpProxy
+	if httpProxy.cache == nil || !util.ManyGlob(httpProxy.config.Cache.Hosts, hostname) {
+		return nil, false, false
+	}
+	entry.Cache = cacheBypass
+	if !cacheableRequest(head, framing) {
+		return nil, false, false
+	}
+	entry.Cache = cacheMiss
+	c = &cacheRequest{key: cacheKey(hostname, head.target)}
+	meta, file := httpProxy.cache.lookup(c.key, head)
+	if meta == nil {
+		return c, false, false
+	}
+	if meta.fresh(time.Now()) && !requestNoCache(head) {
+		defer file.Close()
+		entry.Cache = cacheHit
+		entry.BytesIn = int64(len(head.bytes()))
+		return nil, true, s.serveCached(hostname, head, meta, file, entry, logger)
+	}
+	if !meta.addConditional(head) {
+		file.Close()
+		return c, false, false
+	}
+	c.meta, c.file = meta, file
+	return c, false, false
+}
+
+// revalidated serves the cached response after a 304 Not Modified response
+// from the upstream.
+func (s *session) revalidated(hostname string, head *requestHead, response *responseHead, c *cacheRequest,
+	bodyDone chan error, entry *accesslog.Entry, logger log15.Logger) (keepAlive bool) {
+
+	if err := <-bodyDone; err != nil {
+		logger.Error("error forwarding request body", "err", err)
+		entry.Reason = "body error"
+		s.closeUpstream()
+		return false
+	}
+	if isPersistent(response.proto, &response.messageHead) {
+		s.upstreamIdle = true
+	} else {
+		s.closeUpstream()
+	}
+	s.httpProxy.cache.refresh(c.meta, response)
+	entry.Cache = cacheRevalidated
+	return s.serveCached(hostname, head, c.meta, c.file, entry, logger)
+}
+
+// serveCached sends a cached response from its data file.
+func (s *session) serveCached(hostname string, head *requestHead, meta *cacheMeta, file *os.File,
+	entry *accesslog.Entry, logger log15.Logger) (keepAlive bool) {
+
+	httpProxy := s.httpProxy
+	reader := bufio.NewReader(file)
+	response, err := readResponseHead(reader, httpProxy.config.Maxheadersize, httpProxy.config.Maxheaders)
+	if err != nil {
+		logger.Error("error reading cache file", "err", err)
+		httpProxy.writeError(s.downstreamConn, entry, http.StatusInternalServerError, "cache error")
+		return false
+	}
+	keepAlive = isPersistent(head.proto, &head.messageHead)
+	for _, name := range []string{"connection", "keep-alive", "age", "cache-status"} {
+		response.removeFields(name)
+	}
+	response.setField("age", "Age", strconv.FormatInt(meta.age(time.Now()), 10))
+	response.setField("cache-status", "Cache-Status", cacheStatusField(entry.Cache))
+	if !keepAlive {
+		response.setField("connection", "Connection", "close")
+	}
+	entry.Status = response.status
+	n, err := s.downstreamConn.Write(httpProxy.responseBytes(&response.messageHead, hostname))
+	entry.BytesOut += int64(n)
+	if err == nil {
+		var written int64
+		written, err = io.Copy(s.downstreamConn, reader)
+		entry.BytesOut += written
+	}
+	if err != nil {
+		logger.Info("error writing to downstream", "err", err)
+		entry.Reason = "client error"
+		return false
+	}
+	logger.Debug("served from cache", "cache", entry.Cache)
+	entry.Reason = "completed"
+	return keepAlive
+}
+
+// eof
@@ -0,0 +1,104 @@
+//
+// connect.go
+//
+// Copyright © 2015 Janne Snabb <snabb AT epipe.com>
+//
+// This file is part of Flixproxy.
+//
+// Flixproxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Flixproxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Flixproxy. If not, see <http://www.gnu.org/licenses/>.
+//
+
+package httpproxy
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+
+	"github.com/snabb/flixproxy/accesslog"
+	"github.com/snabb/flixproxy/util"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+const connectEstablished = "HTTP/1.1 200 Connection Established\r\n\r\n"
+
+// handleConnect tunnels a CONNECT request to the requested host:port. The
+// access log entry is logged by the caller.
+func (httpProxy *HTTPProxy) handleConnect(downstream *util.Conn, downstreamConn *util.IdleConn,
+	reader *bufio.Reader, head *requestHead, entry *accesslog.Entry, logger log15.Logger) {
+
+	hostname := head.target
+	entry.Host = hostname
+	logger = logger.New("upstream", hostname)
+
+	if httpProxy.config.LogRequest {
+		logger = logger.New("request", head.requestLine)
+	}
+	if _, _, err := net.SplitHostPort(hostname); err != nil {
+		logger.Error("invalid connect target", "err", err)
+		httpProxy.writeError(downstreamConn, entry, http.StatusBadRequest, "bad request")
+		return
+	}
+	if util.ManyGlob(httpProxy.config.Upstreams, hostname) == false {
+		logger.Error("upstream not allowed")
+		httpProxy.writeError(downstreamConn, entry, http.StatusForbidden, "upstream not allowed")
+		return
+	}
+	// requests inside the tunnel could evade the rules
+	if hasRules(httpProxy.config.Rules, hostname) {
+		logger.Warn("request denied", "err", "request rules are not supported with CONNECT")
+		httpProxy.writeError(downstreamConn, entry, http.StatusForbidden, "denied by rule")
+		return
+	}
+	upstream, backend, err := httpProxy.dialUpstream(hostname, downstream, logger)
+	entry.Upstream = backend
+	if err != nil {
+		httpProxy.writeError(downstreamConn, entry, upstreamErrorStatus(err), "upstream error")
+		return
+	}
+	defer upstream.Close()
+
+	entry.Status = http.StatusOK
+	if _, err = downstreamConn.Write([]byte(connectEstablished)); err != nil {
+		logger.Info("error writing to downstream", "err", err)
+		entry.Reason = "client error"
+		return
+	}
+	entry.BytesOut = int64(len(connectEstablished))
+	util.SetDeadlineSeconds(upstream, httpProxy.config.Deadline)
+
+	// the client may have sent data already after the request head
+	buffered, err := util.ReadBufferedBytes(reader)
+	if err != nil {
+		logger.Error("error reading buffered bytes", "err", err)
+		entry.Reason = "client error"
+		return
+	}
+	if _, err = upstream.Write(buffered); err != nil {
+		logger.Error("error writing to upstream", "err", err)
+		entry.Reason = "upstream error"
+		return
+	}
+	// reset current deadlines
+	util.SetDeadlineSeconds(upstream, 0)
+	util.SetDeadlineSeconds(downstream, 0)
+
+	logger.Debug("tunnel established")
+	stats := util.Proxy(upstream, downstream.TCPConn, httpProxy.config.Idle)
+	entry.BytesIn = int64(len(buffered)) + stats.ToServer
+	entry.BytesOut += stats.ToClient
+	entry.Reason = stats.Reason
+}
+
+// eof
@@ -0,0 +1,153 @@
+//
+// errors.go
+//
+// Copyright © 2015 Janne Snabb <snabb AT epipe.com>
+//
+// This file is part of Flixproxy.
+//
+// Flixproxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Flixproxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Flixproxy. If not, see <http://www.gnu.org/licenses/>.
+//
+
+package httpproxy
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	htmltemplate "html/template"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/snabb/flixproxy/accesslog"
+)
+
+const defaultErrorTemplate = `{{.Status}} {{.StatusText}}
+
+Host: {{.Hostname}}
+Request ID: {{.RequestId}}
+`
+
+type executer interface {
+	Execute(w io.Writer, data interface{}) error
+}
+
+// errorPage is the template for the body of error responses.
+type errorPage struct {
+	template    executer
+	contentType string
+}
+
+type errorPageData struct {
+	Status     int
+	StatusText string
+	Hostname   string
+	RequestId  string
+}
+
+// loadErrorPage parses the error page template file. HTML templates are
+// recognized by the file name extension and escaped accordingly.
+func loadErrorPage(fileName string) (page *errorPage, err error) {
+	if fileName == "" {
+		return &errorPage{
+			template:    template.Must(template.New("error").Parse(defaultErrorTemplate)),
+			contentType: "text/plain; charset=utf-8",
+		}, nil
+	}
+	text, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	page = &errorPage{
+		contentType: mime.TypeByExtension(filepath.Ext(fileName)),
+	}
+	if page.contentType == "" {
+		page.contentType = "text/plain; charset=utf-8"
+	}
+	if strings.HasPrefix(page.contentType, "text/html") {
+		page.template, err = htmltemplate.New("error").Parse(string(text))
+	} else {
+		page.template, err = template.New("error").Parse(string(text))
+	}
+	return page, err
+}
+
+func newRequestId() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// isBadRequest tells if the error reading a request was caused by the
+// request itself rather than the connection.
+func isBadRequest(err error) bool {
+	_, isNetError := err.(net.Error)
+	return !isNetError && err != io.EOF && err != io.ErrUnexpectedEOF && err != errNoHeaderEnd
+}
+
+// upstreamErrorStatus returns the status for a failed upstream connection
+// or response.
+func upstreamErrorStatus(err error) int {
+	if netError, ok := err.(net.Error); ok && netError.Timeout() {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+// writeError sends an error response and records it in the access log
+// entry with reason. The connection is closed afterwards.
+func (httpProxy *HTTPProxy) writeError(w io.Writer, entry *accesslog.Entry, status int, reason string) (err error) {
+	return httpProxy.writeErrorFields(w, entry, status, reason, nil)
+}
+
+// writeErrorFields sends an error response with additional header fields.
+func (httpProxy *HTTPProxy) writeErrorFields(w io.Writer, entry *accesslog.Entry, status int,
+	reason string, fields []string) (err error) {
+
+	entry.Status = status
+	entry.Reason = reason
+
+	var body bytes.Buffer
+	err = httpProxy.errorPage.template.Execute(&body, errorPageData{
+		Status:     status,
+		StatusText: http.StatusText(status),
+		Hostname:   entry.Host,
+		RequestId:  entry.RequestId,
+	})
+	if err != nil {
+		httpProxy.logger.Error("error executing error template", "err", err)
+		body.Reset()
+	}
+	head := "HTTP/1.1 " + strconv.Itoa(status) + " " + http.StatusText(status) + "\r\n"
+	for _, field := range fields {
+		head += field + "\r\n"
+	}
+	head += "Content-Type: " + httpProxy.errorPage.contentType + "\r\n" +
+		"Content-Length: " + strconv.Itoa(body.Len()) + "\r\n" +
+		"Connection: close\r\n\r\n"
+	if _, err = io.WriteString(w, head); err != nil {
+		return err
+	}
+	n, err := w.Write(body.Bytes())
+	entry.BytesOut += int64(len(head) + n)
+	return err
+}
+
+// eof
@@ -0,0 +1,76 @@
+//
+// forwarded.go
+//
+// Copyright © 2015 Janne Snabb <snabb AT epipe.com>
+//
+// This file is part of Flixproxy.
+//
+// Flixproxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Flixproxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Flixproxy. If not, see <http://www.gnu.org/licenses/>.
+//
+
+package httpproxy
+
+import (
+	"net"
+	"strings"
+)
+
+// forwardedNode formats the client address as a node of the RFC 7239
+// Forwarded header.
+func forwardedNode(ip string) string {
+	if strings.Contains(ip, ":") {
+		return "\"[" + ip + "]\""
+	}
+	return ip
+}
+
+// appendField appends a value to a comma separated header field.
+func appendField(head *messageHead, name string, canonicalName string, value string) {
+	var values []string
+	for _, field := range head.fields {
+		if field.name == name && field.value != "" {
+			values = append(values, field.value)
+		}
+	}
+	head.removeFields(name)
+	head.setField(name, canonicalName, strings.Join(append(values, value), ", "))
+}
+
+// addForwarded adds the configured headers conveying the downstream client
+// address to the request.
+func (httpProxy *HTTPProxy) addForwarded(head *requestHead, addr net.Addr) {
+	config := httpProxy.config
+
+	if config.Stripforwarded {
+		head.removeFields("x-forwarded-for")
+		head.removeFields("x-real-ip")
+		head.removeFields("forwarded")
+	}
+	ip, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return
+	}
+	if config.Xforwardedfor {
+		appendField(&head.messageHead, "x-forwarded-for", "X-Forwarded-For", ip)
+	}
+	if config.Xrealip {
+		head.removeFields("x-real-ip")
+		head.setField("x-real-ip", "X-Real-IP", ip)
+	}
+	if config.Forwarded {
+		appendField(&head.messageHead, "forwarded", "Forwarded", "for="+forwardedNode(ip)+";proto=http")
+	}
+}
+
+// eof
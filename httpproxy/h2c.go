@@ -0,0 +1,256 @@
+//
+// h2c.go
+//
+// Copyright © 2015 Janne Snabb <snabb AT epipe.com>
+//
+// This file is part of Flixproxy.
+//
+// Flixproxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Flixproxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Flixproxy. If not, see <http://www.gnu.org/licenses/>.
+//
+
+package httpproxy
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/snabb/flixproxy/accesslog"
+	"github.com/snabb/flixproxy/util"
+	"golang.org/x/net/http2/hpack"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// h2cPreface starts the connections of clients which know beforehand that
+// the server supports HTTP/2 without TLS (RFC 9113 section 3.3).
+const h2cPreface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+const (
+	frameHeaderSize   = 9
+	frameHeaders      = 0x1
+	frameContinuation = 0x9
+	flagEndHeaders    = 0x4
+	flagPadded        = 0x8
+	flagPriority      = 0x20
+	// the client uses the default size until the server tells otherwise
+	hpackTableSize = 4096
+)
+
+var errBadFrame = errors.New("malformed HTTP/2 frame")
+
+// isH2CPreface tells if the connection starts with the HTTP/2 preface.
+// Only the first four bytes are waited for before deciding as HTTP/1
+// requests are never shorter.
+func isH2CPreface(reader *bufio.Reader) bool {
+	start, err := reader.Peek(4)
+	if err != nil || string(start) != h2cPreface[:4] {
+		return false
+	}
+	preface, err := reader.Peek(len(h2cPreface))
+	return err == nil && string(preface) == h2cPreface
+}
+
+// headerBlockFragment returns the header block fragment of a HEADERS
+// frame payload without the padding and priority fields.
+func headerBlockFragment(payload []byte, flags byte) ([]byte, error) {
+	if flags&flagPadded != 0 {
+		if len(payload) < 1 || int(payload[0]) > len(payload)-1 {
+			return nil, errBadFrame
+		}
+		payload = payload[1 : len(payload)-int(payload[0])]
+	}
+	if flags&flagPriority != 0 {
+		if len(payload) < 5 {
+			return nil, errBadFrame
+		}
+		payload = payload[5:]
+	}
+	return payload, nil
+}
+
+// readH2CHeaders reads the preface and the frames up to the end of the
+// header block of the first HEADERS frame. Frames preceding it, such as
+// SETTINGS, are skipped. The bytes read are returned so that they can be
+// forwarded. At most maxSize bytes are read.
+func readH2CHeaders(reader *bufio.Reader, maxSize int) (data []byte, fields []hpack.HeaderField, err error) {
+	data = make([]byte, len(h2cPreface))
+	if _, err = io.ReadFull(reader, data); err != nil {
+		return data, nil, err
+	}
+	var block []byte
+	var stream uint32
+	inHeaders := false
+	for {
+		header := make([]byte, frameHeaderSize)
+		if _, err = io.ReadFull(reader, header); err != nil {
+			return data, nil, err
+		}
+		length := int(header[0])<<16 | int(header[1])<<8 | int(header[2])
+		frameType, flags := header[3], header[4]
+		streamId := binary.BigEndian.Uint32(header[5:]) & 0x7fffffff
+		if len(data)+frameHeaderSize+length > maxSize {
+			return data, nil, errHeaderTooLarge
+		}
+		frame := append(header, make([]byte, length)...)
+		if _, err = io.ReadFull(reader, frame[frameHeaderSize:]); err != nil {
+			return data, nil, err
+		}
+		data = append(data, frame...)
+		payload := frame[frameHeaderSize:]
+
+		switch {
+		case !inHeaders && frameType == frameHeaders:
+			if payload, err = headerBlockFragment(payload, flags); err != nil {
+				return data, nil, err
+			}
+			inHeaders = true
+			stream = streamId
+		case inHeaders:
+			if frameType != frameContinuation || streamId != stream {
+				return data, nil, errBadFrame
+			}
+		default:
+			continue
+		}
+		block = append(block, payload...)
+		if flags&flagEndHeaders != 0 {
+			break
+		}
+	}
+	fields, err = hpack.NewDecoder(hpackTableSize, nil).DecodeFull(block)
+	return data, fields, err
+}
+
+// h2cUnsupported returns the name of a configured feature which modifies
+// the requests to hostname and can not be applied to an h2c connection, or
+// an empty string.
+func (httpProxy *HTTPProxy) h2cUnsupported(hostname string) string {
+	config := httpProxy.config
+	if config.Xforwardedfor || config.Xrealip || config.Forwarded || config.Stripforwarded {
+		return "forwarded headers"
+	}
+	if route := util.LookupRoute(config.Routes, hostname); route != nil && (route.Host != "" || route.Prefix != "") {
+		return "route rewrite"
+	}
+	return ""
+}
+
+// handleH2C forwards an HTTP/2 connection without TLS to the upstream
+// named by the first request. The connection is proxied intact, so the
+// proxy can not authenticate the client or inspect the later requests.
+func (httpProxy *HTTPProxy) handleH2C(downstream *util.Conn, reader *bufio.Reader, authRequired bool,
+	entry *accesslog.Entry, logger log15.Logger) {
+
+	defer httpProxy.accessLog.Log(entry)
+	entry.RequestLine = "PRI * HTTP/2.0"
+	entry.Upgrade = "h2c"
+
+	if authRequired {
+		logger.Warn("access denied", "err", "proxy authentication is not supported with h2c")
+		entry.Reason = "access denied"
+		return
+	}
+	maxSize := httpProxy.config.Maxheadersize
+	if maxSize <= 0 {
+		maxSize = defaultMaxHeaderSize
+	}
+	data, fields, err := readH2CHeaders(reader, maxSize)
+	if err != nil {
+		logger.Error("error reading HTTP/2 headers", "err", err)
+		entry.Reason = "bad request"
+		return
+	}
+	var authority, host, method, p string
+	for _, field := range fields {
+		switch field.Name {
+		case ":authority":
+			authority = field.Value
+		case "host":
+			host = field.Value
+		case ":method":
+			method = field.Value
+		case ":path":
+			p = field.Value
+		}
+	}
+	entry.RequestLine = method + " " + p + " HTTP/2.0"
+	if authority == "" {
+		authority = host
+	}
+	if authority == "" {
+		logger.Error("no hostname found", "request", entry.RequestLine)
+		entry.Reason = "no hostname"
+		return
+	}
+	hostname := httpProxy.upstreamAddress(authority)
+	entry.Host = hostname
+	logger = logger.New("upstream", hostname)
+
+	if httpProxy.config.LogRequest {
+		logger = logger.New("request", entry.RequestLine)
+	}
+	if lookupLocalRoute(httpProxy.config.Local, hostname) != nil {
+		logger.Error("local route not supported with h2c")
+		entry.Reason = "local"
+		return
+	}
+	if util.ManyGlob(httpProxy.config.Upstreams, hostname) == false {
+		logger.Error("upstream not allowed")
+		entry.Reason = "upstream not allowed"
+		return
+	}
+	// rules could be evaded by the later requests on the connection
+	if hasRules(httpProxy.config.Rules, hostname) {
+		logger.Warn("request denied", "err", "request rules are not supported with h2c")
+		entry.Reason = "denied by rule"
+		return
+	}
+	if feature := httpProxy.h2cUnsupported(hostname); feature != "" {
+		logger.Warn("h2c refused", "err", feature+" is not supported with h2c")
+		entry.Reason = "h2c not supported"
+		return
+	}
+	upstream, backend, err := httpProxy.dialUpstream(hostname, downstream, logger)
+	entry.Upstream = backend
+	if err != nil {
+		entry.Reason = "upstream error"
+		return
+	}
+	defer upstream.Close()
+
+	util.SetDeadlineSeconds(upstream, httpProxy.config.Deadline)
+
+	buffered, err := util.ReadBufferedBytes(reader)
+	if err != nil {
+		logger.Error("error reading buffered bytes", "err", err)
+		entry.Reason = "client error"
+		return
+	}
+	if _, err = upstream.Write(append(data, buffered...)); err != nil {
+		logger.Error("error writing to upstream", "err", err)
+		entry.Reason = "upstream error"
+		return
+	}
+	util.SetDeadlineSeconds(upstream, 0)
+	util.SetDeadlineSeconds(downstream, 0)
+
+	logger.Info("h2c connection", "method", method, "path", p)
+	stats := util.Proxy(upstream, downstream.TCPConn, httpProxy.upgradeIdle())
+	entry.BytesIn = int64(len(data)+len(buffered)) + stats.ToServer
+	entry.BytesOut = stats.ToClient
+	entry.Reason = stats.Reason
+}
+
+// eof
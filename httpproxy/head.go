@@ -0,0 +1,264 @@
+//
+// head.go
+//
+// Copyright © 2015 Janne Snabb <snabb AT epipe.com>
+//
+// This file is part of Flixproxy.
+//
+// Flixproxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Flixproxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Flixproxy. If not, see <http://www.gnu.org/licenses/>.
+//
+
+package httpproxy
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strings"
+)
+
+const (
+	defaultMaxHeaderSize = 64 * 1024
+	defaultMaxHeaders    = 100
+)
+
+var (
+	errHeaderTooLarge = errors.New("header section too large")
+	errTooManyHeaders = errors.New("too many header fields")
+	errObsFold        = errors.New("obsolete line folding in header section")
+	errBadHeaderField = errors.New("malformed header field")
+	errNoHeaderEnd    = errors.New("end of header section not found")
+)
+
+type headerField struct {
+	name  string // canonical lower case name
+	value string
+	line  int // index in messageHead.lines
+}
+
+// messageHead is the start-line and header section of an HTTP message.
+// The original lines are kept so that they can be forwarded unchanged.
+type messageHead struct {
+	lines  []string // including line terminators
+	fields []headerField
+}
+
+func isTokenChar(c byte) bool {
+	if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' {
+		return true
+	}
+	return strings.IndexByte("!#$%&'*+-.^_`|~", c) != -1
+}
+
+func isToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if !isTokenChar(s[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// readLine reads one line including the terminator. At most limit bytes
+// are read.
+func readLine(reader *bufio.Reader, limit int) (line string, err error) {
+	var buf []byte
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		if len(buf)+len(chunk) > limit {
+			return "", errHeaderTooLarge
+		}
+		buf = append(buf, chunk...)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			if len(buf) > 0 && err == io.EOF {
+				return "", errNoHeaderEnd
+			}
+			return "", err
+		}
+		return string(buf), nil
+	}
+}
+
+func trimLineEnd(line string) string {
+	line = strings.TrimSuffix(line, "\n")
+	return strings.TrimSuffix(line, "\r")
+}
+
+func parseHeaderField(line string, index int) (field headerField, err error) {
+	if line[0] == ' ' || line[0] == '\t' {
+		return field, errObsFold
+	}
+	colon := strings.IndexByte(line, ':')
+	if colon == -1 || !isToken(line[:colon]) {
+		return field, errBadHeaderField
+	}
+	return headerField{
+		name:  strings.ToLower(line[:colon]),
+		value: strings.Trim(line[colon+1:], " \t"),
+		line:  index,
+	}, nil
+}
+
+// read reads the start-line and the header section. The total size is
+// limited to maxSize bytes and the number of header fields to maxFields.
+// The start-line is returned without the line terminator.
+func (head *messageHead) read(reader *bufio.Reader, maxSize int, maxFields int) (startLine string, err error) {
+	if maxSize <= 0 {
+		maxSize = defaultMaxHeaderSize
+	}
+	if maxFields <= 0 {
+		maxFields = defaultMaxHeaders
+	}
+	size := 0
+	for {
+		line, err := readLine(reader, maxSize-size)
+		if err != nil {
+			return startLine, err
+		}
+		size += len(line)
+		trimmed := trimLineEnd(line)
+
+		if len(head.lines) == 0 {
+			if trimmed == "" {
+				// ignore empty lines preceding the start-line
+				continue
+			}
+			head.lines = append(head.lines, line)
+			startLine = trimmed
+			continue
+		}
+		head.lines = append(head.lines, line)
+		if trimmed == "" {
+			// end of HTTP headers
+			return startLine, nil
+		}
+		if len(head.fields) >= maxFields {
+			return startLine, errTooManyHeaders
+		}
+		field, err := parseHeaderField(trimmed, len(head.lines)-1)
+		if err != nil {
+			return startLine, err
+		}
+		head.fields = append(head.fields, field)
+	}
+}
+
+// getField returns the first header field with the given lower case name.
+func (head *messageHead) getField(name string) *headerField {
+	for i := range head.fields {
+		if head.fields[i].name == name {
+			return &head.fields[i]
+		}
+	}
+	return nil
+}
+
+// countField returns the number of header fields with the given lower
+// case name.
+func (head *messageHead) countField(name string) (count int) {
+	for _, field := range head.fields {
+		if field.name == name {
+			count++
+		}
+	}
+	return count
+}
+
+// hasToken tells if a comma separated header field contains the token.
+func (head *messageHead) hasToken(name string, token string) bool {
+	for _, field := range head.fields {
+		if field.name != name {
+			continue
+		}
+		for _, t := range strings.Split(field.value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// setField replaces the value of the first header field with the given
+// lower case name or adds the field if it is not present.
+func (head *messageHead) setField(name string, canonicalName string, value string) {
+	line := canonicalName + ": " + value + "\r\n"
+	if field := head.getField(name); field != nil {
+		field.value = value
+		head.lines[field.line] = line
+		return
+	}
+	head.addField(name, canonicalName, value)
+}
+
+// addField adds a header field at the end of the header section.
+func (head *messageHead) addField(name string, canonicalName string, value string) {
+	line := canonicalName + ": " + value + "\r\n"
+	// insert before the empty line terminating the header section
+	end := len(head.lines) - 1
+	head.lines = append(head.lines[:end], line, head.lines[end])
+	head.fields = append(head.fields, headerField{name: name, value: value, line: end})
+}
+
+// clone returns a copy of the message head which can be modified
+// separately.
+func (head *messageHead) clone() messageHead {
+	return messageHead{
+		lines:  append([]string(nil), head.lines...),
+		fields: append([]headerField(nil), head.fields...),
+	}
+}
+
+// removeFields removes all header fields with the given lower case name.
+func (head *messageHead) removeFields(name string) {
+	var lines []string
+	var fields []headerField
+	removed := make(map[int]bool)
+	for _, field := range head.fields {
+		if field.name == name {
+			removed[field.line] = true
+		}
+	}
+	if len(removed) == 0 {
+		return
+	}
+	newIndex := make([]int, len(head.lines))
+	for i, line := range head.lines {
+		newIndex[i] = len(lines)
+		if !removed[i] {
+			lines = append(lines, line)
+		}
+	}
+	for _, field := range head.fields {
+		if !removed[field.line] {
+			field.line = newIndex[field.line]
+			fields = append(fields, field)
+		}
+	}
+	head.lines = lines
+	head.fields = fields
+}
+
+// bytes returns the message head as it should be forwarded.
+func (head *messageHead) bytes() []byte {
+	return []byte(strings.Join(head.lines, ""))
+}
+
+// eof
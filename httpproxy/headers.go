@@ -0,0 +1,120 @@
+//
+// headers.go
+//
+// Copyright © 2015 Janne Snabb <snabb AT epipe.com>
+//
+// This file is part of Flixproxy.
+//
+// Flixproxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Flixproxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Flixproxy. If not, see <http://www.gnu.org/licenses/>.
+//
+
+package httpproxy
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/snabb/flixproxy/util"
+)
+
+// HeaderRule modifies the header fields of the responses from the hosts
+// matching Hosts. All matching rules are applied in order. Fields are
+// removed first, then set and finally added.
+type HeaderRule struct {
+	Hosts  []string // glob patterns for matching host:port
+	Add    []string // "Name: value" fields added to the response
+	Set    []string // "Name: value" fields replacing any existing ones
+	Remove []string // names of the removed fields
+}
+
+// fields which define the message framing or the connection and may not
+// be modified by the rules
+var protectedFields = map[string]bool{
+	"connection":        true,
+	"content-length":    true,
+	"keep-alive":        true,
+	"trailer":           true,
+	"transfer-encoding": true,
+	"upgrade":           true,
+}
+
+// splitHeaderField splits "Name: value" to the canonical lower case name,
+// the name as written and the value.
+func splitHeaderField(s string) (name string, canonicalName string, value string, err error) {
+	colon := strings.IndexByte(s, ':')
+	if colon == -1 || !isToken(s[:colon]) || strings.ContainsAny(s, "\r\n") {
+		return "", "", "", errors.New("malformed header field: " + s)
+	}
+	canonicalName = s[:colon]
+	return strings.ToLower(canonicalName), canonicalName, strings.Trim(s[colon+1:], " \t"), nil
+}
+
+func validateHeaderRule(rule HeaderRule) (err error) {
+	var names []string
+	for _, s := range append(append([]string(nil), rule.Add...), rule.Set...) {
+		name, _, _, err := splitHeaderField(s)
+		if err != nil {
+			return err
+		}
+		names = append(names, name)
+	}
+	for _, name := range rule.Remove {
+		if !isToken(name) {
+			return errors.New("malformed header field name: " + name)
+		}
+		names = append(names, strings.ToLower(name))
+	}
+	for _, name := range names {
+		if protectedFields[name] {
+			return errors.New("header field may not be modified: " + name)
+		}
+	}
+	return nil
+}
+
+// responseBytes returns the response head to be sent downstream with the
+// header rules matching hostname applied. The head itself is left
+// unchanged as it is also used for framing and caching.
+func (httpProxy *HTTPProxy) responseBytes(response *messageHead, hostname string) []byte {
+	if len(httpProxy.config.Responseheaders) == 0 {
+		return response.bytes()
+	}
+	head := response.clone()
+	for _, rule := range httpProxy.config.Responseheaders {
+		if !util.ManyGlob(rule.Hosts, hostname) {
+			continue
+		}
+		for _, name := range rule.Remove {
+			if name = strings.ToLower(name); !protectedFields[name] {
+				head.removeFields(name)
+			}
+		}
+		for _, s := range rule.Set {
+			name, canonicalName, value, err := splitHeaderField(s)
+			if err == nil && !protectedFields[name] {
+				head.removeFields(name)
+				head.addField(name, canonicalName, value)
+			}
+		}
+		for _, s := range rule.Add {
+			name, canonicalName, value, err := splitHeaderField(s)
+			if err == nil && !protectedFields[name] {
+				head.addField(name, canonicalName, value)
+			}
+		}
+	}
+	return head.bytes()
+}
+
+// eof
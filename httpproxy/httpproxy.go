@@ -24,128 +24,250 @@ package httpproxy
 import (
 	"bufio"
 	"net"
+	"net/http"
 	"strings"
+	"time"
 
 	"github.com/snabb/flixproxy/access"
+	"github.com/snabb/flixproxy/accesslog"
 	"github.com/snabb/flixproxy/util"
 	"gopkg.in/inconshreveable/log15.v2"
 )
 
 type HTTPProxy struct {
-	config Config
-	access access.Checker
-	logger log15.Logger
+	config    Config
+	access    access.Checker
+	errorPage *errorPage
+	auth      *authenticator
+	cache     *diskCache
+	pool      *connPool
+	accessLog *accesslog.Logger
+	logger    log15.Logger
 }
 
 type Config struct {
-	Id           string
-	Listen       string
-	Acl          string
-	Upstreamport string
-	Upstreams    []string
-	Deadline     int64
-	Idle         int64
-	LogRequest   bool
+	Id              string
+	Listen          string
+	Acl             string
+	Proxyacl        string
+	Upstreamport    string
+	Upstreams       []string
+	Deadline        int64
+	Idle            int64
+	Upgradeidle     int64
+	LogRequest      bool
+	Maxheadersize   int
+	Maxheaders      int
+	Requestaware    bool
+	Xforwardedfor   bool
+	Xrealip         bool
+	Forwarded       bool
+	Stripforwarded  bool
+	Proxyprotocol   []util.ProxyProtocol
+	Routes          []util.Route
+	Parents         []util.Parent
+	Errortemplate   string
+	Accesslog       accesslog.Config
+	Local           []LocalRoute
+	Rules           []Rule
+	Auth            AuthConfig
+	Cache           CacheConfig
+	Pool            PoolConfig
+	Responseheaders []HeaderRule
 }
 
-func New(config Config, access access.Checker, logger log15.Logger) (httpProxy *HTTPProxy) {
+func New(config Config, access access.Checker, proxyAccess access.Checker, logger log15.Logger) (httpProxy *HTTPProxy) {
 	if config.Id != "" {
 		logger = logger.New("id", config.Id)
 	}
+	// a connection is piped as is after its first request unless
+	// requestaware is set, which would bypass the per request features
+	if !config.Requestaware {
+		if feature := requestAwareFeature(config); feature != "" {
+			logger.Warn("requestaware enabled", "feature", feature)
+			config.Requestaware = true
+		}
+	}
+	errorPage, err := loadErrorPage(config.Errortemplate)
+	if err != nil {
+		logger.Crit("error loading error template", "err", err)
+		errorPage, _ = loadErrorPage("")
+	}
+	var localRoutes []LocalRoute
+	for _, route := range config.Local {
+		if !validLocalRoute(route) {
+			logger.Crit("invalid local route ignored", "type", route.Type, "status", route.Status)
+			continue
+		}
+		localRoutes = append(localRoutes, route)
+	}
+	config.Local = localRoutes
+	var headerRules []HeaderRule
+	for _, rule := range config.Responseheaders {
+		if err = validateHeaderRule(rule); err != nil {
+			logger.Crit("invalid response header rule ignored", "err", err)
+			continue
+		}
+		headerRules = append(headerRules, rule)
+	}
+	config.Responseheaders = headerRules
+	auth, err := newAuthenticator(config.Auth)
+	if err != nil {
+		logger.Crit("error loading proxy authentication", "err", err)
+	}
+	cache, err := newDiskCache(config.Cache, logger)
+	if err != nil {
+		logger.Crit("error loading cache", "err", err)
+	}
+	accessLog, err := accesslog.Open(config.Accesslog, config.Id)
+	if err != nil {
+		logger.Crit("error opening access log", "err", err)
+	}
 	httpProxy = &HTTPProxy{
-		config: config,
-		access: access,
-		logger: logger,
+		config:    config,
+		access:    access,
+		errorPage: errorPage,
+		auth:      auth,
+		cache:     cache,
+		pool:      newConnPool(config.Pool),
+		accessLog: accessLog,
+		logger:    logger,
 	}
-	go util.ListenAndServe(httpProxy.config.Listen, httpProxy, logger)
+	go util.ListenAndServe(httpProxy.config.Listen, httpProxy, proxyAccess, logger)
 
 	return httpProxy
 }
 
+// requestAwareFeature returns the name of a configured feature which must
+// see every request of a connection or an empty string.
+func requestAwareFeature(config Config) string {
+	for _, route := range config.Routes {
+		if route.Host != "" || route.Prefix != "" {
+			return "route rewrite"
+		}
+	}
+	switch {
+	case len(config.Rules) != 0:
+		return "rules"
+	case config.Auth.Htpasswd != "" || len(config.Auth.Tokens) != 0:
+		// the credentials must be removed from every request
+		return "auth"
+	case config.Xforwardedfor || config.Xrealip || config.Forwarded || config.Stripforwarded:
+		// headers sent by the client on later requests would be trusted
+		return "forwarded headers"
+	case config.Cache.Directory != "" && config.Cache.Size > 0:
+		return "cache"
+	case config.Pool.Maxidle > 0:
+		return "pool"
+	case len(config.Responseheaders) != 0:
+		return "responseheaders"
+	}
+	return ""
+}
+
 func (httpProxy *HTTPProxy) Stop() {
 	// something
 }
 
-func (httpProxy *HTTPProxy) HandleConn(downstream *net.TCPConn) {
+func (httpProxy *HTTPProxy) HandleConn(downstream *util.Conn) {
 	defer downstream.Close()
 
 	util.SetDeadlineSeconds(downstream, httpProxy.config.Deadline)
 
-	logger := httpProxy.logger.New("src", downstream.RemoteAddr())
+	connLogger := httpProxy.logger.New("src", downstream.RemoteAddr())
+	entry := newAccessEntry(downstream)
+	logger := connLogger.New("reqid", entry.RequestId)
 
-	if !httpProxy.access.AllowedAddr(downstream.RemoteAddr()) {
+	// clients not allowed by the ACL may authenticate instead
+	authRequired := !httpProxy.access.AllowedAddr(downstream.RemoteAddr())
+	if authRequired && httpProxy.auth == nil {
 		logger.Warn("access denied")
+		entry.Reason = "access denied"
+		httpProxy.accessLog.Log(entry)
 		return
 	}
 
-	reader := bufio.NewReader(downstream)
-	hostname := ""
-	var lines []string
-	var requestLine string
-	for {
-		line, err := reader.ReadString('\n')
-		if err != nil {
-			if netError, ok := err.(net.Error); ok && netError.Timeout() {
-				logger.Info("timeout reading request")
-			} else {
-				logger.Error("error reading request", "err", err)
+	downstreamConn := &util.IdleConn{Conn: downstream}
+	reader := bufio.NewReader(downstreamConn)
+	if isH2CPreface(reader) {
+		httpProxy.handleH2C(downstream, reader, authRequired, entry, logger)
+		return
+	}
+	head, err := readRequestHead(reader, httpProxy.config.Maxheadersize, httpProxy.config.Maxheaders)
+	if err != nil {
+		if netError, ok := err.(net.Error); ok && netError.Timeout() {
+			logger.Info("timeout reading request")
+		} else {
+			logger.Error("error reading request", "err", err, "request", head.requestLine)
+			if isBadRequest(err) {
+				setAccessRequest(entry, head)
+				httpProxy.writeError(downstreamConn, entry, http.StatusBadRequest, "bad request")
+				httpProxy.accessLog.Log(entry)
 			}
-			return
-		}
-		lines = append(lines, line)
-		line = strings.TrimSuffix(line, "\n")
-		line = strings.TrimSuffix(line, "\r")
-		if len(lines) == 1 {
-			// this is the HTTP Request-Line
-			requestLine = line
-			continue
-		}
-		if line == "" {
-			// end of HTTP headers
-			break
-		}
-		if strings.HasPrefix(line, "Host:") {
-			hostname = strings.TrimPrefix(line, "Host:")
-			hostname = strings.TrimSpace(hostname)
-			break
 		}
+		return
 	}
+	setAccessRequest(entry, head)
+	// explicit proxy clients send requests for any host on the same
+	// connection, so they are always handled request by request
+	if httpProxy.config.Requestaware || head.absolute {
+		httpProxy.serveRequests(downstream, downstreamConn, reader, head, entry, authRequired, connLogger)
+		return
+	}
+	if !httpProxy.checkAuth(downstreamConn, head, authRequired, entry, logger) {
+		httpProxy.accessLog.Log(entry)
+		return
+	}
+	if head.method == "CONNECT" {
+		httpProxy.handleConnect(downstream, downstreamConn, reader, head, entry, logger)
+		httpProxy.accessLog.Log(entry)
+		return
+	}
+	defer httpProxy.accessLog.Log(entry)
+
+	requestLine := head.requestLine
+	hostname := head.host
 	if hostname == "" {
 		logger.Error("no hostname found", "request", requestLine)
+		httpProxy.writeError(downstreamConn, entry, http.StatusBadRequest, "no hostname")
 		return
 	}
-	if strings.Index(hostname, ":") == -1 {
-		hostname = hostname + ":" + httpProxy.config.Upstreamport
-	}
+	hostname = httpProxy.upstreamAddress(hostname)
+	entry.Host = hostname
 	logger = logger.New("upstream", hostname)
 
 	if httpProxy.config.LogRequest {
 		logger = logger.New("request", requestLine)
 	}
+	if route := lookupLocalRoute(httpProxy.config.Local, hostname); route != nil {
+		httpProxy.serveLocal(downstreamConn, route, head, downstream, entry, false, logger)
+		return
+	}
 	if util.ManyGlob(httpProxy.config.Upstreams, hostname) == false {
 		logger.Error("upstream not allowed")
+		httpProxy.writeError(downstreamConn, entry, http.StatusForbidden, "upstream not allowed")
 		return
 	}
-	uaddr, err := net.ResolveTCPAddr("tcp", hostname)
-	if err != nil {
-		logger.Error("upstream address error", "err", err)
+	if !httpProxy.checkRules(downstreamConn, head, hostname, entry, logger) {
 		return
 	}
-	upstream, err := net.DialTCP("tcp", nil, uaddr)
+	upstream, backend, err := httpProxy.dialUpstream(hostname, downstream, logger)
+	entry.Upstream = backend
 	if err != nil {
-		logger.Error("error connecting to upstream", "err", err)
+		httpProxy.writeError(downstreamConn, entry, upstreamErrorStatus(err), "upstream error")
 		return
 	}
 	defer upstream.Close()
-	logger.Debug("connected to upstream")
 
 	util.SetDeadlineSeconds(upstream, httpProxy.config.Deadline)
 
-	for _, line := range lines {
-		if _, err = upstream.Write([]byte(line)); err != nil {
-			logger.Error("error writing to upstream", "err", err)
-			return
-		}
+	httpProxy.addForwarded(head, downstream.RemoteAddr())
+	httpProxy.rewriteRequest(head, hostname, logger)
+	headBytes := head.bytes()
+	if _, err = upstream.Write(headBytes); err != nil {
+		logger.Error("error writing to upstream", "err", err)
+		entry.Reason = "upstream error"
+		return
 	}
 
 	// get all bytes buffered in bufio.Reader and send them to upstream so that we can resume
@@ -153,17 +275,136 @@ func (httpProxy *HTTPProxy) HandleConn(downstream *net.TCPConn) {
 	buffered, err := util.ReadBufferedBytes(reader)
 	if err != nil {
 		logger.Error("error reading buffered bytes", "err", err)
+		entry.Reason = "client error"
 		return
 	}
 	if _, err = upstream.Write(buffered); err != nil {
 		logger.Error("error writing to upstream", "err", err)
+		entry.Reason = "upstream error"
 		return
 	}
+	entry.BytesIn = int64(len(headBytes) + len(buffered))
+
+	// the longer idle time of upgraded connections is used only if the
+	// upstream switches protocols, which is seen from the response if the
+	// request has no body to be piped first
+	idle := httpProxy.config.Idle
+	if upgrade := upgradeProtocol(&head.messageHead); upgrade != "" {
+		logger.Debug("upgrade requested", "upgrade", upgrade)
+		if framing, err := requestFraming(head); err == nil && framing.bodyType == bodyNone {
+			upgraded, ok := httpProxy.forwardUpgradeResponse(upstream, downstreamConn, upgrade, entry, logger)
+			if !ok {
+				return
+			}
+			if upgraded {
+				idle = httpProxy.upgradeIdle()
+			}
+		}
+	}
 	// reset current deadlines
 	util.SetDeadlineSeconds(upstream, 0)
 	util.SetDeadlineSeconds(downstream, 0)
 
-	util.Proxy(upstream, downstream, httpProxy.config.Idle)
+	// the rest of the connection is proxied as is
+	stats := util.Proxy(upstream, downstream.TCPConn, idle)
+	entry.BytesIn += stats.ToServer
+	entry.BytesOut += stats.ToClient
+	entry.Reason = stats.Reason
+}
+
+// forwardUpgradeResponse reads the response to an upgrade request and
+// sends it downstream with any data following it. It tells if the upstream
+// switched protocols and whether the connection can be proxied further.
+func (httpProxy *HTTPProxy) forwardUpgradeResponse(upstream *net.TCPConn, downstreamConn *util.IdleConn,
+	upgrade string, entry *accesslog.Entry, logger log15.Logger) (upgraded bool, ok bool) {
+
+	reader := bufio.NewReader(upstream)
+	response, err := readResponseHead(reader, httpProxy.config.Maxheadersize, httpProxy.config.Maxheaders)
+	if err != nil {
+		logger.Error("error reading response", "err", err)
+		httpProxy.writeError(downstreamConn, entry, upstreamErrorStatus(err), "invalid response")
+		return false, false
+	}
+	entry.Status = response.status
+	buffered, err := util.ReadBufferedBytes(reader)
+	if err != nil {
+		logger.Error("error reading buffered bytes", "err", err)
+		entry.Reason = "upstream error"
+		return false, false
+	}
+	n, err := downstreamConn.Write(append(response.bytes(), buffered...))
+	entry.BytesOut += int64(n)
+	if err != nil {
+		logger.Info("error writing to downstream", "err", err)
+		entry.Reason = "client error"
+		return false, false
+	}
+	if response.status != http.StatusSwitchingProtocols {
+		return false, true
+	}
+	if entry.Upgrade = upgradeProtocol(&response.messageHead); entry.Upgrade == "" {
+		entry.Upgrade = upgrade
+	}
+	logger.Info("protocol upgraded", "upgrade", entry.Upgrade)
+	return true, true
+}
+
+// upstreamAddress adds the default upstream port to hostname if needed.
+func (httpProxy *HTTPProxy) upstreamAddress(hostname string) string {
+	if strings.Index(hostname, ":") == -1 {
+		return hostname + ":" + httpProxy.config.Upstreamport
+	}
+	return hostname
+}
+
+func (httpProxy *HTTPProxy) dialUpstream(hostname string, downstream *util.Conn, logger log15.Logger) (upstream *net.TCPConn, backend string, err error) {
+	upstream, backend, err = util.DialUpstream(httpProxy.config.Routes, httpProxy.config.Parents, hostname)
+	if err != nil {
+		logger.Error("error connecting to upstream", "backend", backend, "err", err)
+		return nil, backend, err
+	}
+	logger.Debug("connected to upstream", "backend", backend)
+
+	if version := util.ProxyProtocolVersion(httpProxy.config.Proxyprotocol, hostname); version != 0 {
+		if err = util.WriteProxyHeader(upstream, version, downstream); err != nil {
+			logger.Error("error writing proxy protocol header", "err", err)
+			upstream.Close()
+			return nil, backend, err
+		}
+	}
+	return upstream, backend, nil
+}
+
+// rewriteRequest rewrites the Host header and path prefix of a request
+// according to the route of the upstream.
+func (httpProxy *HTTPProxy) rewriteRequest(head *requestHead, hostname string, logger log15.Logger) {
+	route := util.LookupRoute(httpProxy.config.Routes, hostname)
+	if route == nil || (route.Host == "" && route.Prefix == "") {
+		return
+	}
+	head.rewrite(route.Host, route.Prefix, route.Newprefix)
+	logger.Debug("request rewritten", "host", head.host, "target", head.target)
+}
+
+// newAccessEntry starts an access log entry for a request received from
+// downstream.
+func newAccessEntry(downstream *util.Conn) *accesslog.Entry {
+	return &accesslog.Entry{
+		Start:     time.Now(),
+		Client:    downstream.RemoteAddr(),
+		RequestId: newRequestId(),
+	}
+}
+
+func setAccessRequest(entry *accesslog.Entry, head *requestHead) {
+	entry.RequestLine = head.requestLine
+	entry.Host = head.host
+	if field := head.getField("referer"); field != nil {
+		entry.Referer = field.value
+	}
+	if field := head.getField("user-agent"); field != nil {
+		entry.UserAgent = field.value
+	}
 }
 
 // eof
@@ -0,0 +1,273 @@
+//
+// local.go
+//
+// Copyright © 2015 Janne Snabb <snabb AT epipe.com>
+//
+// This file is part of Flixproxy.
+//
+// Flixproxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Flixproxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Flixproxy. If not, see <http://www.gnu.org/licenses/>.
+//
+
+package httpproxy
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/snabb/flixproxy/accesslog"
+	"github.com/snabb/flixproxy/util"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// LocalRoute defines hosts which are answered by the proxy itself instead
+// of being proxied upstream.
+type LocalRoute struct {
+	Hosts     []string // glob patterns for matching host:port
+	Type      string   // pac, check, static or redirect
+	Proxy     string   // pac: proxy address, the local address if empty
+	Directory string   // static: directory of the served files
+	Status    int      // redirect: 301 or 308, 301 if not set
+}
+
+// lookupLocalRoute returns the first local route matching hostname or nil.
+func lookupLocalRoute(routes []LocalRoute, hostname string) *LocalRoute {
+	for i := range routes {
+		if util.ManyGlob(routes[i].Hosts, hostname) {
+			return &routes[i]
+		}
+	}
+	return nil
+}
+
+func validLocalRoute(route LocalRoute) bool {
+	switch route.Type {
+	case "pac", "check", "static":
+		return true
+	case "redirect":
+		return route.Status == 0 || route.Status == http.StatusMovedPermanently ||
+			route.Status == http.StatusPermanentRedirect
+	}
+	return false
+}
+
+// pacScript generates a proxy auto-config script which directs the
+// upstreams allowed by the configuration to proxy and everything else
+// to direct connections.
+func (httpProxy *HTTPProxy) pacScript(proxy string) string {
+	var script bytes.Buffer
+	script.WriteString("function FindProxyForURL(url, host) {\n" +
+		"\tvar m = url.match(/^([a-z]+):\\/\\/(\\[[^\\]]*\\]|[^\\/:?#]*)(:([0-9]+))?/i);\n" +
+		"\tvar port = (m && m[4]) ? m[4] : ((m && m[1].toLowerCase() == \"https\") ? \"443\" : \"80\");\n" +
+		"\tvar target = host + \":\" + port;\n")
+	for _, upstream := range httpProxy.config.Upstreams {
+		script.WriteString("\tif (shExpMatch(target, " + strconv.Quote(upstream) + "))\n" +
+			"\t\treturn " + strconv.Quote("PROXY "+proxy) + ";\n")
+	}
+	script.WriteString("\treturn \"DIRECT\";\n}\n")
+	return script.String()
+}
+
+// requestPath returns the cleaned and unescaped path of the request
+// target.
+func requestPath(target string) (p string, err error) {
+	if i := strings.IndexByte(target, '?'); i != -1 {
+		target = target[:i]
+	}
+	p, err = url.PathUnescape(target)
+	if err != nil {
+		return "", err
+	}
+	return path.Clean("/" + p), nil
+}
+
+// httpsLocation returns the https:// URL of the requested resource.
+func httpsLocation(head *requestHead) string {
+	host := head.host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+		if strings.IndexByte(host, ':') != -1 {
+			host = "[" + host + "]"
+		}
+	}
+	target := head.target
+	if !strings.HasPrefix(target, "/") {
+		target = "/"
+	}
+	return "https://" + host + target
+}
+
+// writeLocal sends a response generated by the proxy. Fields are the
+// header fields in addition to the framing ones. The body is omitted for
+// HEAD requests.
+func writeLocal(w io.Writer, entry *accesslog.Entry, head *requestHead, status int,
+	fields []string, body io.Reader, length int64, keepAlive bool) (err error) {
+
+	entry.Status = status
+	responseHead := "HTTP/1.1 " + strconv.Itoa(status) + " " + http.StatusText(status) + "\r\n"
+	for _, field := range fields {
+		responseHead += field + "\r\n"
+	}
+	responseHead += "Content-Length: " + strconv.FormatInt(length, 10) + "\r\n"
+	if !keepAlive {
+		responseHead += "Connection: close\r\n"
+	} else if head.proto == "HTTP/1.0" {
+		responseHead += "Connection: keep-alive\r\n"
+	}
+	responseHead += "\r\n"
+	n, err := io.WriteString(w, responseHead)
+	entry.BytesOut += int64(n)
+	if err != nil || head.method == "HEAD" {
+		return err
+	}
+	written, err := io.CopyN(w, body, length)
+	entry.BytesOut += written
+	return err
+}
+
+// serveLocal answers the request according to the local route. It returns
+// false if the downstream connection should be closed.
+func (httpProxy *HTTPProxy) serveLocal(w io.Writer, route *LocalRoute, head *requestHead,
+	downstream *util.Conn, entry *accesslog.Entry, keepAlive bool, logger log15.Logger) bool {
+
+	logger = logger.New("local", route.Type)
+	entry.Reason = "local"
+
+	if route.Type == "redirect" {
+		return httpProxy.serveRedirect(w, route, head, entry, keepAlive, logger)
+	}
+	if head.method != "GET" && head.method != "HEAD" {
+		logger.Info("method not allowed", "method", head.method)
+		httpProxy.writeError(w, entry, http.StatusMethodNotAllowed, "local")
+		return false
+	}
+	p, err := requestPath(head.target)
+	if err != nil {
+		logger.Info("invalid request path", "err", err)
+		httpProxy.writeError(w, entry, http.StatusBadRequest, "bad request")
+		return false
+	}
+
+	var body string
+	var contentType string
+	switch route.Type {
+	case "pac":
+		if p != "/wpad.dat" && p != "/proxy.pac" {
+			httpProxy.writeError(w, entry, http.StatusNotFound, "local")
+			return false
+		}
+		proxy := route.Proxy
+		if proxy == "" {
+			proxy = downstream.LocalAddr().String()
+		}
+		body = httpProxy.pacScript(proxy)
+		contentType = "application/x-ns-proxy-autoconfig"
+	case "check":
+		body = "You are using Flixproxy.\n\n"
+		if httpProxy.config.Id != "" {
+			body += "Proxy: " + httpProxy.config.Id + "\n"
+		}
+		body += "Client: " + downstream.RemoteAddr().String() + "\n" +
+			"Host: " + head.host + "\n" +
+			"Request ID: " + entry.RequestId + "\n"
+		contentType = "text/plain; charset=utf-8"
+	case "static":
+		return httpProxy.serveFile(w, route.Directory, p, head, entry, keepAlive, logger)
+	default:
+		logger.Error("invalid local route type")
+		httpProxy.writeError(w, entry, http.StatusInternalServerError, "local")
+		return false
+	}
+	if err = writeLocal(w, entry, head, http.StatusOK, []string{"Content-Type: " + contentType},
+		strings.NewReader(body), int64(len(body)), keepAlive); err != nil {
+		logger.Info("error writing to downstream", "err", err)
+		entry.Reason = "client error"
+		return false
+	}
+	logger.Debug("served locally", "path", p)
+	return keepAlive
+}
+
+// serveFile sends a file from directory. Index.html is served for
+// directories.
+func (httpProxy *HTTPProxy) serveFile(w io.Writer, directory string, p string, head *requestHead,
+	entry *accesslog.Entry, keepAlive bool, logger log15.Logger) bool {
+
+	fileName := filepath.Join(directory, filepath.FromSlash(p))
+	info, err := os.Stat(fileName)
+	if err == nil && info.IsDir() {
+		fileName = filepath.Join(fileName, "index.html")
+		info, err = os.Stat(fileName)
+	}
+	if err != nil || !info.Mode().IsRegular() {
+		logger.Info("file not found", "path", p)
+		httpProxy.writeError(w, entry, http.StatusNotFound, "local")
+		return false
+	}
+	file, err := os.Open(fileName)
+	if err != nil {
+		logger.Error("error opening file", "err", err)
+		httpProxy.writeError(w, entry, http.StatusForbidden, "local")
+		return false
+	}
+	defer file.Close()
+
+	contentType := mime.TypeByExtension(filepath.Ext(fileName))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	fields := []string{"Content-Type: " + contentType}
+	if err = writeLocal(w, entry, head, http.StatusOK, fields, file, info.Size(), keepAlive); err != nil {
+		logger.Info("error writing to downstream", "err", err)
+		entry.Reason = "client error"
+		return false
+	}
+	logger.Debug("served locally", "path", p)
+	return keepAlive
+}
+
+// serveRedirect redirects the request to the same URL with https.
+func (httpProxy *HTTPProxy) serveRedirect(w io.Writer, route *LocalRoute, head *requestHead,
+	entry *accesslog.Entry, keepAlive bool, logger log15.Logger) bool {
+
+	status := route.Status
+	if status == 0 {
+		status = http.StatusMovedPermanently
+	}
+	location := httpsLocation(head)
+	body := "Redirecting to " + location + "\n"
+	fields := []string{
+		"Location: " + location,
+		"Content-Type: text/plain; charset=utf-8",
+	}
+	entry.Reason = "redirect"
+	if err := writeLocal(w, entry, head, status, fields,
+		strings.NewReader(body), int64(len(body)), keepAlive); err != nil {
+		logger.Info("error writing to downstream", "err", err)
+		entry.Reason = "client error"
+		return false
+	}
+	logger.Debug("redirected", "location", location)
+	return keepAlive
+}
+
+// eof
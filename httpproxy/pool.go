@@ -0,0 +1,171 @@
+//
+// pool.go
+//
+// Copyright © 2015 Janne Snabb <snabb AT epipe.com>
+//
+// This file is part of Flixproxy.
+//
+// Flixproxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Flixproxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Flixproxy. If not, see <http://www.gnu.org/licenses/>.
+//
+
+package httpproxy
+
+import (
+	"bufio"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/snabb/flixproxy/util"
+)
+
+// PoolConfig defines the pool of idle upstream connections which are
+// shared by the downstream connections in request aware mode.
+type PoolConfig struct {
+	Maxidle int   // maximum number of idle connections per backend, 0 disables
+	Idle    int64 // idle time limit of pooled connections (s)
+}
+
+// default idle time limit of pooled connections (s)
+const defaultPoolIdle = 60
+
+// time to wait for data when checking if a pooled connection is still open
+const poolCheckTimeout = time.Millisecond
+
+type pooledConn struct {
+	upstream     *net.TCPConn
+	upstreamConn *util.IdleConn
+	reader       *bufio.Reader
+	backend      string
+	since        time.Time
+}
+
+type connPool struct {
+	config PoolConfig
+	mutex  sync.Mutex
+	idle   map[string][]*pooledConn
+}
+
+// newConnPool returns nil if pooling is not configured.
+func newConnPool(config PoolConfig) (pool *connPool) {
+	if config.Maxidle <= 0 {
+		return nil
+	}
+	if config.Idle <= 0 {
+		config.Idle = defaultPoolIdle
+	}
+	pool = &connPool{
+		config: config,
+		idle:   make(map[string][]*pooledConn),
+	}
+	go pool.expire()
+	return pool
+}
+
+// poolKey identifies the connections to backend made for hostname. The
+// parent proxy is a part of the key as it depends on the hostname.
+func (httpProxy *HTTPProxy) poolKey(hostname string, backend string) string {
+	if parent := util.LookupParent(httpProxy.config.Parents, hostname); parent != nil {
+		return parent.Address + " " + backend
+	}
+	return backend
+}
+
+func (pool *connPool) idleTimeout() time.Duration {
+	return time.Duration(pool.config.Idle) * time.Second
+}
+
+// expire closes the connections which have been idle for too long.
+func (pool *connPool) expire() {
+	for range time.Tick(pool.idleTimeout()) {
+		now := time.Now()
+		pool.mutex.Lock()
+		for key, conns := range pool.idle {
+			var keep []*pooledConn
+			for _, conn := range conns {
+				if now.Sub(conn.since) >= pool.idleTimeout() {
+					conn.upstream.Close()
+				} else {
+					keep = append(keep, conn)
+				}
+			}
+			if len(keep) == 0 {
+				delete(pool.idle, key)
+			} else {
+				pool.idle[key] = keep
+			}
+		}
+		pool.mutex.Unlock()
+	}
+}
+
+// alive tells if the upstream has not closed the connection or sent
+// anything unexpected while it was idle.
+func (conn *pooledConn) alive() bool {
+	timeout := conn.upstreamConn.Timeout
+	conn.upstreamConn.Timeout = 0
+	defer func() { conn.upstreamConn.Timeout = timeout }()
+
+	conn.upstream.SetReadDeadline(time.Now().Add(poolCheckTimeout))
+	_, err := conn.reader.Peek(1)
+	// IdleConn does not touch the deadline if the idle time is not limited
+	conn.upstream.SetReadDeadline(time.Time{})
+	netError, ok := err.(net.Error)
+	return ok && netError.Timeout()
+}
+
+// get returns an idle connection to one of the keys, most recently used
+// first, or nil.
+func (pool *connPool) get(keys []string) (conn *pooledConn) {
+	for _, key := range keys {
+		for {
+			pool.mutex.Lock()
+			conns := pool.idle[key]
+			if len(conns) == 0 {
+				pool.mutex.Unlock()
+				break
+			}
+			conn = conns[len(conns)-1]
+			pool.idle[key] = conns[:len(conns)-1]
+			pool.mutex.Unlock()
+
+			if time.Since(conn.since) < pool.idleTimeout() && conn.alive() {
+				return conn
+			}
+			conn.upstream.Close()
+		}
+	}
+	return nil
+}
+
+// put adds an idle connection to the pool. The connection is closed if
+// the pool is full or it has unread data.
+func (pool *connPool) put(key string, conn *pooledConn) {
+	if conn.reader.Buffered() != 0 {
+		conn.upstream.Close()
+		return
+	}
+	conn.since = time.Now()
+
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	if len(pool.idle[key]) >= pool.config.Maxidle {
+		conn.upstream.Close()
+		return
+	}
+	pool.idle[key] = append(pool.idle[key], conn)
+}
+
+// eof
@@ -0,0 +1,187 @@
+//
+// pool_test.go
+//
+// Copyright © 2015 Janne Snabb <snabb AT epipe.com>
+//
+// This file is part of Flixproxy.
+//
+// Flixproxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Flixproxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Flixproxy. If not, see <http://www.gnu.org/licenses/>.
+//
+
+package httpproxy
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/snabb/flixproxy/util"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+type allowAll struct{}
+
+func (allowAll) AllowedIP(ip net.IP) bool       { return true }
+func (allowAll) AllowedAddr(addr net.Addr) bool { return true }
+
+// startTestProxy serves connections with httpProxy on a local port and
+// returns its address.
+func startTestProxy(t *testing.T, httpProxy *HTTPProxy) string {
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.AcceptTCP()
+			if err != nil {
+				return
+			}
+			go httpProxy.HandleConn(&util.Conn{TCPConn: conn})
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func newTestProxy(config Config) *HTTPProxy {
+	logger := log15.New()
+	logger.SetHandler(log15.DiscardHandler())
+	return &HTTPProxy{
+		config:    config,
+		access:    allowAll{},
+		errorPage: mustLoadErrorPage(),
+		pool:      newConnPool(config.Pool),
+		logger:    logger,
+	}
+}
+
+func mustLoadErrorPage() *errorPage {
+	page, _ := loadErrorPage("")
+	return page
+}
+
+// get sends one GET request on a new keep-alive connection to the proxy
+// and returns the status and the body of the response.
+func get(t *testing.T, proxy string, host string) (status int, body string) {
+	conn, err := net.Dial("tcp", proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: " + host + "\r\n\r\n"))
+	response, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(response.Body)
+	return response.StatusCode, string(b)
+}
+
+// testBackend answers with the address of the client connection so that
+// connection reuse can be seen.
+func testBackend(t *testing.T) (listener net.Listener) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go http.Serve(listener, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.RemoteAddr))
+	}))
+	return listener
+}
+
+// waitPooled waits until the session of the closed downstream connection
+// has returned its upstream connection to the pool.
+func waitPooled(t *testing.T, pool *connPool, key string) {
+	for i := 0; i < 100; i++ {
+		pool.mutex.Lock()
+		n := len(pool.idle[key])
+		pool.mutex.Unlock()
+		if n != 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("connection was not pooled")
+}
+
+func TestPoolReuseWithoutIdleLimit(t *testing.T) {
+	backend := testBackend(t).Addr().String()
+	httpProxy := newTestProxy(Config{
+		Upstreams:    []string{"127.0.0.1:*"},
+		Requestaware: true,
+		Pool:         PoolConfig{Maxidle: 4},
+	})
+	proxy := startTestProxy(t, httpProxy)
+	var first string
+	for i := 0; i < 3; i++ {
+		if i != 0 {
+			waitPooled(t, httpProxy.pool, backend)
+		}
+		status, body := get(t, proxy, backend)
+		if status != http.StatusOK {
+			t.Fatalf("request %d: status %d", i, status)
+		}
+		if i == 0 {
+			first = body
+		} else if body != first {
+			t.Errorf("request %d: upstream connection from %s, expected pooled %s", i, body, first)
+		}
+	}
+}
+
+func TestPoolRetryClosedConnection(t *testing.T) {
+	// the backend answers the first request on each connection and
+	// closes the connection when it receives the second one
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				if _, err := http.ReadRequest(reader); err != nil {
+					return
+				}
+				conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"))
+				http.ReadRequest(reader)
+			}()
+		}
+	}()
+	backend := listener.Addr().String()
+	proxy := startTestProxy(t, newTestProxy(Config{
+		Upstreams:    []string{"127.0.0.1:*"},
+		Requestaware: true,
+		Pool:         PoolConfig{Maxidle: 4},
+	}))
+	for i := 0; i < 3; i++ {
+		if status, body := get(t, proxy, backend); status != http.StatusOK || body != "ok" {
+			t.Errorf("request %d: status %d body %q", i, status, body)
+		}
+	}
+}
+
+// eof
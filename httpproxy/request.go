@@ -0,0 +1,141 @@
+//
+// request.go
+//
+// Copyright © 2015 Janne Snabb <snabb AT epipe.com>
+//
+// This file is part of Flixproxy.
+//
+// Flixproxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Flixproxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Flixproxy. If not, see <http://www.gnu.org/licenses/>.
+//
+
+package httpproxy
+
+import (
+	"bufio"
+	"errors"
+	"strings"
+)
+
+var (
+	errDuplicateHost   = errors.New("duplicate Host header field")
+	errBadRequestLine  = errors.New("malformed request line")
+	errUnsupportedHTTP = errors.New("unsupported HTTP version")
+	errBadTarget       = errors.New("unsupported request target")
+)
+
+// requestHead is the parsed request-line and header section of an HTTP
+// request.
+type requestHead struct {
+	messageHead
+	requestLine string
+	method      string
+	target      string
+	proto       string
+	host        string
+	absolute    bool // request target was in absolute-form
+}
+
+func (head *requestHead) parseRequestLine(line string) (err error) {
+	head.requestLine = line
+	parts := strings.Split(line, " ")
+	if len(parts) != 3 || !isToken(parts[0]) || parts[1] == "" {
+		return errBadRequestLine
+	}
+	if !strings.HasPrefix(parts[2], "HTTP/1.") || len(parts[2]) != 8 {
+		return errUnsupportedHTTP
+	}
+	head.method = parts[0]
+	head.target = parts[1]
+	head.proto = parts[2]
+	return nil
+}
+
+// readRequestHead reads and parses the request-line and the header
+// section. The total size is limited to maxSize bytes and the number of
+// header fields to maxFields.
+func readRequestHead(reader *bufio.Reader, maxSize int, maxFields int) (head *requestHead, err error) {
+	head = new(requestHead)
+	requestLine, err := head.read(reader, maxSize, maxFields)
+	if requestLine != "" {
+		if err := head.parseRequestLine(requestLine); err != nil {
+			return head, err
+		}
+	}
+	if err != nil {
+		return head, err
+	}
+	if head.countField("host") > 1 {
+		return head, errDuplicateHost
+	}
+	if host := head.getField("host"); host != nil {
+		head.host = host.value
+	}
+	if err = head.absoluteToOrigin(); err != nil {
+		return head, err
+	}
+	return head, nil
+}
+
+// absoluteToOrigin rewrites an absolute-form request target as used with
+// explicit proxies to origin-form. The Host header is replaced with the
+// authority of the URI (RFC 9112 section 3.2.2).
+func (head *requestHead) absoluteToOrigin() (err error) {
+	if head.method == "CONNECT" || strings.HasPrefix(head.target, "/") || head.target == "*" {
+		return nil
+	}
+	const scheme = "http://"
+	if len(head.target) < len(scheme) || !strings.EqualFold(head.target[:len(scheme)], scheme) {
+		return errBadTarget
+	}
+	rest := head.target[len(scheme):]
+	authority, path := rest, "/"
+	if i := strings.IndexAny(rest, "/?"); i != -1 {
+		authority, path = rest[:i], rest[i:]
+		if path[0] == '?' {
+			path = "/" + path
+		}
+	}
+	if i := strings.LastIndexByte(authority, '@'); i != -1 {
+		authority = authority[i+1:]
+	}
+	if authority == "" {
+		return errBadTarget
+	}
+	head.absolute = true
+	head.setTarget(path)
+	head.host = authority
+	head.setField("host", "Host", authority)
+	return nil
+}
+
+// setTarget replaces the request target in the request-line.
+func (head *requestHead) setTarget(target string) {
+	head.target = target
+	head.requestLine = head.method + " " + target + " " + head.proto
+	head.lines[0] = head.requestLine + "\r\n"
+}
+
+// rewrite replaces the Host header if host is not empty and the path
+// prefix if the target starts with prefix.
+func (head *requestHead) rewrite(host string, prefix string, newPrefix string) {
+	if host != "" {
+		head.host = host
+		head.setField("host", "Host", host)
+	}
+	if prefix != "" && strings.HasPrefix(head.target, prefix) {
+		head.setTarget(newPrefix + head.target[len(prefix):])
+	}
+}
+
+// eof
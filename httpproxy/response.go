@@ -0,0 +1,69 @@
+//
+// response.go
+//
+// Copyright © 2015 Janne Snabb <snabb AT epipe.com>
+//
+// This file is part of Flixproxy.
+//
+// Flixproxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Flixproxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Flixproxy. If not, see <http://www.gnu.org/licenses/>.
+//
+
+package httpproxy
+
+import (
+	"bufio"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+var errBadStatusLine = errors.New("malformed status line")
+
+// responseHead is the parsed status-line and header section of an HTTP
+// response.
+type responseHead struct {
+	messageHead
+	statusLine string
+	proto      string
+	status     int
+}
+
+func (head *responseHead) parseStatusLine(line string) (err error) {
+	head.statusLine = line
+	parts := strings.SplitN(line, " ", 3)
+	if len(parts) < 2 || !strings.HasPrefix(parts[0], "HTTP/1.") || len(parts[1]) != 3 {
+		return errBadStatusLine
+	}
+	if head.status, err = strconv.Atoi(parts[1]); err != nil {
+		return errBadStatusLine
+	}
+	head.proto = parts[0]
+	return nil
+}
+
+// readResponseHead reads and parses the status-line and the header
+// section.
+func readResponseHead(reader *bufio.Reader, maxSize int, maxFields int) (head *responseHead, err error) {
+	head = new(responseHead)
+	statusLine, err := head.read(reader, maxSize, maxFields)
+	if err != nil {
+		return head, err
+	}
+	if err = head.parseStatusLine(statusLine); err != nil {
+		return head, err
+	}
+	return head, nil
+}
+
+// eof
@@ -0,0 +1,145 @@
+//
+// rules.go
+//
+// Copyright © 2015 Janne Snabb <snabb AT epipe.com>
+//
+// This file is part of Flixproxy.
+//
+// Flixproxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Flixproxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Flixproxy. If not, see <http://www.gnu.org/licenses/>.
+//
+
+package httpproxy
+
+import (
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+
+	"github.com/snabb/flixproxy/accesslog"
+	"github.com/snabb/flixproxy/util"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// Rule allows or denies requests to the hosts matching Hosts by method
+// and path. The first matching rule applies and requests not matching any
+// rule are allowed. Paths are matched after unescaping and removing dot
+// segments, without the query.
+type Rule struct {
+	Name    string   // rule name for logging, the rule number if empty
+	Hosts   []string // glob patterns for matching host:port
+	Allow   bool
+	Methods []string // empty matches all methods
+	Paths   []string // glob patterns for matching the path
+	Regexp  Regexp   // regular expression for matching the path
+}
+
+type Regexp struct {
+	*regexp.Regexp
+}
+
+// String returns the source text of the regular expression, empty if it
+// is not set.
+func (re Regexp) String() string {
+	if re.Regexp == nil {
+		return ""
+	}
+	return re.Regexp.String()
+}
+
+func (re *Regexp) UnmarshalYAML(unmarshal func(v interface{}) error) (err error) {
+	var restring string
+	if err = unmarshal(&restring); err != nil {
+		return
+	}
+	re.Regexp, err = regexp.Compile(restring)
+	return err
+}
+
+func (rule *Rule) matches(hostname string, method string, p string) bool {
+	if !util.ManyGlob(rule.Hosts, hostname) {
+		return false
+	}
+	if len(rule.Methods) != 0 {
+		found := false
+		for _, m := range rule.Methods {
+			if m == method {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(rule.Paths) != 0 && !util.ManyGlob(rule.Paths, p) {
+		return false
+	}
+	if rule.Regexp.Regexp != nil && !rule.Regexp.MatchString(p) {
+		return false
+	}
+	return true
+}
+
+// matchRule returns the name of the first rule matching the request and
+// whether it allows the request. Name is empty if no rule matched.
+func matchRule(rules []Rule, hostname string, method string, p string) (name string, allow bool) {
+	for i := range rules {
+		if rules[i].matches(hostname, method, p) {
+			name = rules[i].Name
+			if name == "" {
+				name = strconv.Itoa(i + 1)
+			}
+			return name, rules[i].Allow
+		}
+	}
+	return "", true
+}
+
+// hasRules tells if any of the rules applies to hostname.
+func hasRules(rules []Rule, hostname string) bool {
+	for i := range rules {
+		if util.ManyGlob(rules[i].Hosts, hostname) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkRules sends a 403 response if the request is denied by the rules.
+func (httpProxy *HTTPProxy) checkRules(w io.Writer, head *requestHead, hostname string,
+	entry *accesslog.Entry, logger log15.Logger) (allowed bool) {
+
+	if len(httpProxy.config.Rules) == 0 {
+		return true
+	}
+	p, err := requestPath(head.target)
+	if err != nil {
+		logger.Error("invalid request path", "err", err)
+		httpProxy.writeError(w, entry, http.StatusBadRequest, "bad request")
+		return false
+	}
+	name, allow := matchRule(httpProxy.config.Rules, hostname, head.method, p)
+	if !allow {
+		logger.Warn("request denied", "rule", name, "method", head.method, "path", p)
+		httpProxy.writeError(w, entry, http.StatusForbidden, "denied by rule "+name)
+		return false
+	}
+	if name != "" {
+		logger.Debug("request allowed", "rule", name)
+	}
+	return true
+}
+
+// eof
@@ -0,0 +1,107 @@
+//
+// rules_test.go
+//
+// Copyright © 2015 Janne Snabb <snabb AT epipe.com>
+//
+// This file is part of Flixproxy.
+//
+// Flixproxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Flixproxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Flixproxy. If not, see <http://www.gnu.org/licenses/>.
+//
+
+package httpproxy
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestRequestPath(t *testing.T) {
+	tests := []struct {
+		target string
+		p      string
+		err    bool
+	}{
+		{"/", "/", false},
+		{"", "/", false},
+		{"/admin?x=1", "/admin", false},
+		{"/admin/?x=/public", "/admin", false},
+		{"//admin", "/admin", false},
+		{"/public/../admin", "/admin", false},
+		{"/api/%2e%2e/admin", "/admin", false},
+		{"/api/%2E%2E/%2E%2E/admin", "/admin", false},
+		{"/%61dmin", "/admin", false},
+		{"/api/%2fadmin", "/api/admin", false},
+		{"/api/%zz", "", true},
+	}
+	for _, test := range tests {
+		p, err := requestPath(test.target)
+		if (err != nil) != test.err {
+			t.Errorf("%q: error %v, expected error %v", test.target, err, test.err)
+			continue
+		}
+		if p != test.p {
+			t.Errorf("%q: path %q, expected %q", test.target, p, test.p)
+		}
+	}
+}
+
+func TestMatchRule(t *testing.T) {
+	rules := []Rule{
+		{
+			Name:  "admin",
+			Hosts: []string{"example.com:80"},
+			Paths: []string{"/admin", "/admin/*"},
+		},
+		{
+			Name:    "secret",
+			Hosts:   []string{"example.com:80"},
+			Methods: []string{"GET"},
+			Regexp:  Regexp{regexp.MustCompile(`^/secret\b`)},
+		},
+	}
+	tests := []struct {
+		host   string
+		method string
+		target string
+		rule   string
+		allow  bool
+	}{
+		{"example.com:80", "GET", "/", "", true},
+		{"example.com:80", "GET", "/admin", "admin", false},
+		{"example.com:80", "GET", "/admin?next=/", "admin", false},
+		{"example.com:80", "GET", "/public?/admin", "", true},
+		{"example.com:80", "GET", "//admin", "admin", false},
+		{"example.com:80", "GET", "/api/%2e%2e/admin", "admin", false},
+		{"example.com:80", "POST", "/api/%2e%2e/admin/users", "admin", false},
+		{"example.com:80", "GET", "/administrator", "", true},
+		{"example.com:80", "GET", "/secret/key", "secret", false},
+		{"example.com:80", "POST", "/secret/key", "", true},
+		{"example.com:80", "GET", "/public/../secret", "secret", false},
+		{"other.example.com:80", "GET", "/admin", "", true},
+	}
+	for _, test := range tests {
+		p, err := requestPath(test.target)
+		if err != nil {
+			t.Errorf("%q: %v", test.target, err)
+			continue
+		}
+		rule, allow := matchRule(rules, test.host, test.method, p)
+		if rule != test.rule || allow != test.allow {
+			t.Errorf("%s %s %s: rule %q allow %v, expected rule %q allow %v",
+				test.method, test.host, test.target, rule, allow, test.rule, test.allow)
+		}
+	}
+}
+
+// eof
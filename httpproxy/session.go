@@ -0,0 +1,485 @@
+//
+// session.go
+//
+// Copyright © 2015 Janne Snabb <snabb AT epipe.com>
+//
+// This file is part of Flixproxy.
+//
+// Flixproxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Flixproxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Flixproxy. If not, see <http://www.gnu.org/licenses/>.
+//
+
+package httpproxy
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/snabb/flixproxy/accesslog"
+	"github.com/snabb/flixproxy/util"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// session proxies the requests of one downstream connection in request
+// aware mode. Each request is routed separately according to its Host
+// header.
+type session struct {
+	httpProxy        *HTTPProxy
+	downstream       *util.Conn
+	downstreamConn   *util.IdleConn
+	reader           *bufio.Reader
+	upstream         *net.TCPConn
+	upstreamConn     *util.IdleConn
+	upstreamReader   *bufio.Reader
+	upstreamHost     string
+	upstreamBackend  string
+	upstreamPooled   bool // the connection may be returned to the pool
+	upstreamIdle     bool // a response has been read completely
+	upstreamFromPool bool // the connection was taken from the pool
+	authRequired     bool
+	logger           log15.Logger
+}
+
+// isIdempotent tells if a request with the method can be repeated
+// without changing its effect (RFC 9110 section 9.2.2).
+func isIdempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
+	}
+	return false
+}
+
+// isPersistent tells if the connection can be kept open after the
+// message according to its protocol version and Connection header.
+func isPersistent(proto string, head *messageHead) bool {
+	if head.hasToken("connection", "close") {
+		return false
+	}
+	if proto == "HTTP/1.0" {
+		return head.hasToken("connection", "keep-alive")
+	}
+	return true
+}
+
+// upgradeProtocol returns the value of the Upgrade header field if the
+// message requests or confirms a protocol upgrade such as WebSocket or
+// h2c.
+func upgradeProtocol(head *messageHead) string {
+	if !head.hasToken("connection", "upgrade") {
+		return ""
+	}
+	if field := head.getField("upgrade"); field != nil {
+		return strings.ToLower(field.value)
+	}
+	return ""
+}
+
+// upgradeIdle returns the idle timeout for upgraded connections.
+func (httpProxy *HTTPProxy) upgradeIdle() int64 {
+	if httpProxy.config.Upgradeidle != 0 {
+		return httpProxy.config.Upgradeidle
+	}
+	return httpProxy.config.Idle
+}
+
+func (httpProxy *HTTPProxy) serveRequests(downstream *util.Conn, downstreamConn *util.IdleConn,
+	reader *bufio.Reader, head *requestHead, entry *accesslog.Entry, authRequired bool, logger log15.Logger) {
+
+	s := &session{
+		httpProxy:      httpProxy,
+		downstream:     downstream,
+		downstreamConn: downstreamConn,
+		reader:         reader,
+		authRequired:   authRequired,
+		logger:         logger,
+	}
+	defer s.releaseUpstream()
+
+	// reset the deadline for the first request, idle timeout applies
+	// from now on
+	util.SetDeadlineSeconds(downstream, 0)
+	downstreamConn.Timeout = httpProxy.config.Idle
+
+	for {
+		keepAlive := s.serveRequest(head, entry)
+		httpProxy.accessLog.Log(entry)
+		if !keepAlive {
+			return
+		}
+		entry = newAccessEntry(downstream)
+		var err error
+		head, err = readRequestHead(reader, httpProxy.config.Maxheadersize, httpProxy.config.Maxheaders)
+		if err != nil {
+			if err == io.EOF {
+				logger.Debug("connection closed")
+			} else if netError, ok := err.(net.Error); ok && netError.Timeout() {
+				logger.Debug("idle timeout")
+			} else {
+				logger.Error("error reading request", "reqid", entry.RequestId, "err", err, "request", head.requestLine)
+				if isBadRequest(err) {
+					setAccessRequest(entry, head)
+					httpProxy.writeError(downstreamConn, entry, http.StatusBadRequest, "bad request")
+					httpProxy.accessLog.Log(entry)
+				}
+			}
+			return
+		}
+		entry.Start = time.Now()
+		setAccessRequest(entry, head)
+	}
+}
+
+func (s *session) closeUpstream() {
+	if s.upstream != nil {
+		s.upstream.Close()
+		s.upstream = nil
+		s.upstreamHost = ""
+		s.upstreamBackend = ""
+	}
+}
+
+// releaseUpstream returns the upstream connection to the pool if it is
+// idle and closes it otherwise.
+func (s *session) releaseUpstream() {
+	if s.upstream == nil || !s.upstreamPooled || !s.upstreamIdle {
+		s.closeUpstream()
+		return
+	}
+	s.httpProxy.pool.put(s.httpProxy.poolKey(s.upstreamHost, s.upstreamBackend), &pooledConn{
+		upstream:     s.upstream,
+		upstreamConn: s.upstreamConn,
+		reader:       s.upstreamReader,
+		backend:      s.upstreamBackend,
+	})
+	s.upstream = nil
+	s.upstreamHost = ""
+	s.upstreamBackend = ""
+}
+
+func (s *session) connectUpstream(hostname string, logger log15.Logger) (err error) {
+	if s.upstream != nil && s.upstreamHost == hostname {
+		return nil
+	}
+	s.releaseUpstream()
+
+	httpProxy := s.httpProxy
+	// connections starting with a PROXY protocol header belong to one
+	// client and are never pooled
+	s.upstreamPooled = httpProxy.pool != nil &&
+		util.ProxyProtocolVersion(httpProxy.config.Proxyprotocol, hostname) == 0
+	if s.upstreamPooled {
+		var keys []string
+		for _, backend := range util.UpstreamAddresses(httpProxy.config.Routes, hostname) {
+			keys = append(keys, httpProxy.poolKey(hostname, backend))
+		}
+		if conn := httpProxy.pool.get(keys); conn != nil {
+			logger.Debug("reusing pooled upstream connection", "backend", conn.backend)
+			s.upstream = conn.upstream
+			s.upstreamHost = hostname
+			s.upstreamBackend = conn.backend
+			s.upstreamConn = conn.upstreamConn
+			s.upstreamReader = conn.reader
+			s.upstreamFromPool = true
+			return nil
+		}
+	}
+	return s.dialUpstream(hostname, logger)
+}
+
+// dialUpstream opens a new connection to the upstream.
+func (s *session) dialUpstream(hostname string, logger log15.Logger) (err error) {
+	httpProxy := s.httpProxy
+	upstream, backend, err := httpProxy.dialUpstream(hostname, s.downstream, logger)
+	if err != nil {
+		s.upstreamBackend = backend
+		return err
+	}
+	s.upstream = upstream
+	s.upstreamHost = hostname
+	s.upstreamBackend = backend
+	s.upstreamConn = &util.IdleConn{Conn: upstream, Timeout: httpProxy.config.Idle}
+	s.upstreamReader = bufio.NewReader(s.upstreamConn)
+	s.upstreamFromPool = false
+	return nil
+}
+
+// serveRequest forwards one request and its response and records them in
+// the access log entry. It returns false if the downstream connection
+// should be closed.
+func (s *session) serveRequest(head *requestHead, entry *accesslog.Entry) (keepAlive bool) {
+	httpProxy := s.httpProxy
+	logger := s.logger.New("reqid", entry.RequestId)
+
+	if !httpProxy.checkAuth(s.downstreamConn, head, s.authRequired, entry, logger) {
+		return false
+	}
+	if head.method == "CONNECT" {
+		s.closeUpstream()
+		httpProxy.handleConnect(s.downstream, s.downstreamConn, s.reader, head, entry, logger)
+		return false
+	}
+	if head.host == "" {
+		logger.Error("no hostname found", "request", head.requestLine)
+		httpProxy.writeError(s.downstreamConn, entry, http.StatusBadRequest, "no hostname")
+		return false
+	}
+	hostname := httpProxy.upstreamAddress(head.host)
+	entry.Host = hostname
+	logger = logger.New("upstream", hostname)
+
+	if httpProxy.config.LogRequest {
+		logger = logger.New("request", head.requestLine)
+	}
+	if route := lookupLocalRoute(httpProxy.config.Local, hostname); route != nil {
+		return s.serveLocal(route, head, entry, logger)
+	}
+	if util.ManyGlob(httpProxy.config.Upstreams, hostname) == false {
+		logger.Error("upstream not allowed")
+		httpProxy.writeError(s.downstreamConn, entry, http.StatusForbidden, "upstream not allowed")
+		return false
+	}
+	if !httpProxy.checkRules(s.downstreamConn, head, hostname, entry, logger) {
+		return false
+	}
+	framing, err := requestFraming(head)
+	if err != nil {
+		logger.Error("invalid request", "err", err)
+		httpProxy.writeError(s.downstreamConn, entry, http.StatusBadRequest, "bad request")
+		return false
+	}
+	cacheReq, served, keepAlive := s.lookupCache(hostname, head, framing, entry, logger)
+	if served {
+		return keepAlive
+	}
+	if cacheReq != nil {
+		defer cacheReq.close()
+	}
+	upgrade := upgradeProtocol(&head.messageHead)
+	if upgrade != "" {
+		logger.Debug("upgrade requested", "upgrade", upgrade)
+	}
+	httpProxy.addForwarded(head, s.downstream.RemoteAddr())
+	httpProxy.rewriteRequest(head, hostname, logger)
+	headBytes := head.bytes()
+
+	// the upstream may have closed a pooled connection while it was idle,
+	// requests which are safe to repeat are then sent once more on a new
+	// connection if nothing was received
+	retry := isIdempotent(head.method) && framing.bodyType == bodyNone
+	connect := s.connectUpstream
+	for {
+		err = connect(hostname, logger)
+		entry.Upstream = s.upstreamBackend
+		if err != nil {
+			httpProxy.writeError(s.downstreamConn, entry, upstreamErrorStatus(err), "upstream error")
+			return false
+		}
+		retry = retry && s.upstreamFromPool
+		s.upstreamIdle = false
+		if _, err = s.upstreamConn.Write(headBytes); err != nil {
+			s.closeUpstream()
+			if retry {
+				logger.Info("retrying request on a new connection", "err", err)
+				retry = false
+				connect = s.dialUpstream
+				continue
+			}
+			logger.Error("error writing to upstream", "err", err)
+			entry.Reason = "upstream error"
+			return false
+		}
+		if !retry {
+			break
+		}
+		// there is no request body, wait for the response to start
+		_, err = s.upstreamReader.Peek(1)
+		if err == nil {
+			break
+		}
+		s.closeUpstream()
+		if netError, ok := err.(net.Error); ok && netError.Timeout() {
+			logger.Error("error reading response", "err", err)
+			httpProxy.writeError(s.downstreamConn, entry, upstreamErrorStatus(err), "invalid response")
+			return false
+		}
+		logger.Info("retrying request on a new connection", "err", err)
+		retry = false
+		connect = s.dialUpstream
+	}
+	entry.BytesIn = int64(len(headBytes))
+
+	// the request body is copied concurrently so that interim responses
+	// such as 100 Continue reach the client
+	bodyDone := make(chan error, 1)
+	var bodyWritten int64
+	go func() {
+		var err error
+		bodyWritten, err = copyBody(s.upstreamConn, s.reader, framing)
+		bodyDone <- err
+	}()
+
+	var response *responseHead
+	for {
+		response, err = readResponseHead(s.upstreamReader, httpProxy.config.Maxheadersize, httpProxy.config.Maxheaders)
+		if err != nil {
+			logger.Error("error reading response", "err", err)
+			s.closeUpstream()
+			httpProxy.writeError(s.downstreamConn, entry, upstreamErrorStatus(err), "invalid response")
+			return false
+		}
+		entry.Status = response.status
+		if cacheReq != nil && cacheReq.meta != nil && response.status == http.StatusNotModified {
+			return s.revalidated(hostname, head, response, cacheReq, bodyDone, entry, logger)
+		}
+		if entry.Cache != "" && response.status/100 != 1 {
+			response.setField("cache-status", "Cache-Status", cacheStatusField(entry.Cache))
+		}
+		if response.status == 101 && upgrade == "" {
+			logger.Error("invalid response", "err", "101 response without upgrade request")
+			s.closeUpstream()
+			httpProxy.writeError(s.downstreamConn, entry, http.StatusBadGateway, "invalid response")
+			return false
+		}
+		responseBytes := response.bytes()
+		if response.status/100 != 1 {
+			responseBytes = httpProxy.responseBytes(&response.messageHead, hostname)
+		}
+		n, err := s.downstreamConn.Write(responseBytes)
+		entry.BytesOut += int64(n)
+		if err != nil {
+			logger.Info("error writing to downstream", "err", err)
+			entry.Reason = "client error"
+			return false
+		}
+		if response.status == 101 {
+			// switching protocols, the connection becomes a tunnel
+			if err = <-bodyDone; err != nil {
+				logger.Error("error forwarding request body", "err", err)
+				entry.Reason = "client error"
+				return false
+			}
+			entry.BytesIn += bodyWritten
+			entry.Upgrade = upgradeProtocol(&response.messageHead)
+			if entry.Upgrade == "" {
+				entry.Upgrade = upgrade
+			}
+			logger.Info("protocol upgraded", "upgrade", entry.Upgrade)
+			s.tunnel(entry, logger)
+			return false
+		}
+		if response.status/100 != 1 {
+			break
+		}
+	}
+	responseBody, err := responseFraming(head.method, response)
+	if err != nil {
+		// the response head has been sent already
+		logger.Error("invalid response", "err", err)
+		entry.Reason = "invalid response"
+		s.closeUpstream()
+		return false
+	}
+	var bodyWriter io.Writer = s.downstreamConn
+	var store *cacheWriter
+	if cacheReq != nil {
+		if store = httpProxy.cache.newWriter(cacheReq.key, head, response, responseBody); store != nil {
+			bodyWriter = io.MultiWriter(s.downstreamConn, store)
+		}
+	}
+	n, err := copyBody(bodyWriter, s.upstreamReader, responseBody)
+	entry.BytesOut += n
+	if err != nil {
+		logger.Info("error forwarding response body", "err", err)
+		entry.Reason = "body error"
+		if store != nil {
+			store.abort()
+		}
+		s.closeUpstream()
+		return false
+	}
+	if store != nil {
+		store.commit()
+	}
+	err = <-bodyDone
+	entry.BytesIn += bodyWritten
+	if err != nil {
+		logger.Error("error forwarding request body", "err", err)
+		entry.Reason = "body error"
+		s.closeUpstream()
+		return false
+	}
+	logger.Debug("request proxied", "status", response.status)
+	entry.Reason = "completed"
+
+	if !isPersistent(response.proto, &response.messageHead) || responseBody.bodyType == bodyClose {
+		s.closeUpstream()
+		return false
+	}
+	s.upstreamIdle = true
+	return isPersistent(head.proto, &head.messageHead)
+}
+
+// serveLocal discards the request body and answers the request locally.
+func (s *session) serveLocal(route *LocalRoute, head *requestHead, entry *accesslog.Entry, logger log15.Logger) (keepAlive bool) {
+	framing, err := requestFraming(head)
+	if err != nil {
+		logger.Error("invalid request", "err", err)
+		s.httpProxy.writeError(s.downstreamConn, entry, http.StatusBadRequest, "bad request")
+		return false
+	}
+	n, err := copyBody(ioutil.Discard, s.reader, framing)
+	entry.BytesIn = int64(len(head.bytes())) + n
+	if err != nil {
+		logger.Info("error reading request body", "err", err)
+		entry.Reason = "client error"
+		return false
+	}
+	keepAlive = isPersistent(head.proto, &head.messageHead)
+	return s.httpProxy.serveLocal(s.downstreamConn, route, head, s.downstream, entry, keepAlive, logger)
+}
+
+// tunnel forwards any buffered bytes and proxies the connections as is.
+func (s *session) tunnel(entry *accesslog.Entry, logger log15.Logger) {
+	toUpstream, err := util.ReadBufferedBytes(s.reader)
+	if err == nil {
+		_, err = s.upstreamConn.Write(toUpstream)
+	}
+	var toDownstream []byte
+	if err == nil {
+		toDownstream, err = util.ReadBufferedBytes(s.upstreamReader)
+	}
+	if err == nil {
+		_, err = s.downstreamConn.Write(toDownstream)
+	}
+	if err != nil {
+		logger.Error("error forwarding buffered bytes", "err", err)
+		entry.Reason = "tunnel error"
+		return
+	}
+	// reset current deadlines
+	util.SetDeadlineSeconds(s.upstream, 0)
+	util.SetDeadlineSeconds(s.downstream, 0)
+
+	stats := util.Proxy(s.upstream, s.downstream.TCPConn, s.httpProxy.upgradeIdle())
+	entry.BytesIn += int64(len(toUpstream)) + stats.ToServer
+	entry.BytesOut += int64(len(toDownstream)) + stats.ToClient
+	entry.Reason = stats.Reason
+}
+
+// eof
@@ -24,38 +24,53 @@ package tlsproxy
 import (
 	"io"
 	"net"
+	"strings"
+	"time"
 
 	"github.com/snabb/flixproxy/access"
+	"github.com/snabb/flixproxy/accesslog"
 	"github.com/snabb/flixproxy/util"
 	"gopkg.in/inconshreveable/log15.v2"
 )
 
 type TLSProxy struct {
-	config Config
-	access access.Checker
-	logger log15.Logger
+	config    Config
+	access    access.Checker
+	accessLog *accesslog.Logger
+	logger    log15.Logger
 }
 
 type Config struct {
-	Id           string
-	Listen       string
-	Acl          string
-	Upstreamport string
-	Upstreams    []string
-	Deadline     int64
-	Idle         int64
+	Id            string
+	Listen        string
+	Acl           string
+	Proxyacl      string
+	Upstreamport  string
+	Upstreams     []string
+	Deadline      int64
+	Idle          int64
+	Dohhosts      []string
+	Proxyprotocol []util.ProxyProtocol
+	Routes        []util.Route
+	Parents       []util.Parent
+	Accesslog     accesslog.Config
 }
 
-func New(config Config, access access.Checker, logger log15.Logger) (tlsProxy *TLSProxy) {
+func New(config Config, access access.Checker, proxyAccess access.Checker, logger log15.Logger) (tlsProxy *TLSProxy) {
 	if config.Id != "" {
 		logger = logger.New("id", config.Id)
 	}
+	accessLog, err := accesslog.Open(config.Accesslog, config.Id)
+	if err != nil {
+		logger.Crit("error opening access log", "err", err)
+	}
 	tlsProxy = &TLSProxy{
-		config: config,
-		access: access,
-		logger: logger,
+		config:    config,
+		access:    access,
+		accessLog: accessLog,
+		logger:    logger,
 	}
-	go util.ListenAndServe(tlsProxy.config.Listen, tlsProxy, logger)
+	go util.ListenAndServe(tlsProxy.config.Listen, tlsProxy, proxyAccess, logger)
 
 	return tlsProxy
 }
@@ -64,15 +79,19 @@ func (tlsProxy *TLSProxy) Stop() {
 	// something
 }
 
-func (tlsProxy *TLSProxy) HandleConn(downstream *net.TCPConn) {
+func (tlsProxy *TLSProxy) HandleConn(downstream *util.Conn) {
 	defer downstream.Close()
 
 	util.SetDeadlineSeconds(downstream, tlsProxy.config.Deadline)
 
 	logger := tlsProxy.logger.New("src", downstream.RemoteAddr())
 
+	entry := &accesslog.Entry{Start: time.Now(), Client: downstream.RemoteAddr()}
+	defer tlsProxy.accessLog.Log(entry)
+
 	if !tlsProxy.access.AllowedAddr(downstream.RemoteAddr()) {
 		logger.Warn("access denied")
+		entry.Reason = "access denied"
 		return
 	}
 
@@ -84,10 +103,12 @@ func (tlsProxy *TLSProxy) HandleConn(downstream *net.TCPConn) {
 		} else {
 			logger.Info("error reading first byte", "err", err)
 		}
+		entry.Reason = "client error"
 		return
 	}
 	if firstByte[0] != 0x16 { // recordTypeHandshake
 		logger.Warn("record type not handshake", "fistbyte", firstByte)
+		entry.Reason = "not tls"
 		return
 	}
 
@@ -95,10 +116,12 @@ func (tlsProxy *TLSProxy) HandleConn(downstream *net.TCPConn) {
 	_, err = io.ReadFull(downstream, versionBytes)
 	if err != nil {
 		logger.Info("error reading version bytes", "err", err)
+		entry.Reason = "client error"
 		return
 	}
 	if versionBytes[0] < 3 || (versionBytes[0] == 3 && versionBytes[1] < 1) {
 		logger.Warn("SSL < 3.1 not supported", "versionbytes", versionBytes)
+		entry.Reason = "not tls"
 		return
 	}
 
@@ -106,6 +129,7 @@ func (tlsProxy *TLSProxy) HandleConn(downstream *net.TCPConn) {
 	_, err = io.ReadFull(downstream, restLengthBytes)
 	if err != nil {
 		logger.Info("error reading restLength bytes", "err", err)
+		entry.Reason = "client error"
 		return
 	}
 	restLength := int(restLengthBytes[0])<<8 + int(restLengthBytes[1])
@@ -114,54 +138,76 @@ func (tlsProxy *TLSProxy) HandleConn(downstream *net.TCPConn) {
 	_, err = io.ReadFull(downstream, rest)
 	if err != nil {
 		logger.Info("error reading rest of bytes", "err", err)
+		entry.Reason = "client error"
 		return
 	}
 	if len(rest) == 0 || rest[0] != 1 { // typeClientHello
 		logger.Warn("did not get ClientHello")
+		entry.Reason = "not tls"
 		return
 	}
 
 	m := new(clientHelloMsg)
 	if !m.unmarshal(rest) {
 		logger.Warn("error parsing ClientHello")
+		entry.Reason = "not tls"
 		return
 	}
 	if m.serverName == "" {
 		logger.Error("no server name found")
+		entry.Reason = "no server name"
 		return
 	}
 	target := m.serverName + ":" + tlsProxy.config.Upstreamport
+	entry.Sni = m.serverName
+	entry.Host = target
 
 	logger = logger.New("upstream", target)
 
-	if util.ManyGlob(tlsProxy.config.Upstreams, target) == false {
-		logger.Error("upstream not allowed")
+	if util.ManyGlob(tlsProxy.config.Dohhosts, strings.ToLower(m.serverName)) {
+		logger.Info("doh blocked")
+		entry.Reason = "doh blocked"
 		return
 	}
-	uaddr, err := net.ResolveTCPAddr("tcp", target)
-	if err != nil {
-		logger.Error("upstream address error", "err", err)
+
+	if util.ManyGlob(tlsProxy.config.Upstreams, target) == false {
+		logger.Error("upstream not allowed")
+		entry.Reason = "upstream not allowed"
 		return
 	}
-	upstream, err := net.DialTCP("tcp", nil, uaddr)
+	upstream, backend, err := util.DialUpstream(tlsProxy.config.Routes, tlsProxy.config.Parents, target)
+	entry.Upstream = backend
 	if err != nil {
-		logger.Error("error connecting to upstream", "err", err)
+		logger.Error("error connecting to upstream", "backend", backend, "err", err)
+		entry.Reason = "upstream error"
 		return
 	}
 	defer upstream.Close()
-	logger.Debug("connected to upstream")
+	logger.Debug("connected to upstream", "backend", backend)
 
 	util.SetDeadlineSeconds(upstream, tlsProxy.config.Deadline)
 
-	if _, err = upstream.Write(append(append(append(firstByte, versionBytes...), restLengthBytes...), rest...)); err != nil {
+	if version := util.ProxyProtocolVersion(tlsProxy.config.Proxyprotocol, target); version != 0 {
+		if err = util.WriteProxyHeader(upstream, version, downstream); err != nil {
+			logger.Error("error writing proxy protocol header", "err", err)
+			entry.Reason = "upstream error"
+			return
+		}
+	}
+	hello := append(append(append(firstByte, versionBytes...), restLengthBytes...), rest...)
+	if _, err = upstream.Write(hello); err != nil {
 		logger.Error("error writing to upstream", "err", err)
+		entry.Reason = "upstream error"
 		return
 	}
 	// reset current deadlines
 	util.SetDeadlineSeconds(upstream, 0)
 	util.SetDeadlineSeconds(downstream, 0)
 
-	util.Proxy(upstream, downstream, tlsProxy.config.Idle)
+	stats := util.Proxy(upstream, downstream.TCPConn, tlsProxy.config.Idle)
+	entry.BytesIn = int64(len(hello)) + stats.ToServer
+	entry.BytesOut = stats.ToClient
+	entry.Reason = stats.Reason
 }
 
 // eof
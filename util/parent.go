@@ -0,0 +1,207 @@
+//
+// parent.go
+//
+// Copyright © 2015 Janne Snabb <snabb AT epipe.com>
+//
+// This file is part of Flixproxy.
+//
+// Flixproxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Flixproxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Flixproxy. If not, see <http://www.gnu.org/licenses/>.
+//
+
+package util
+
+import (
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Parent is a parent proxy through which upstreams matching the glob
+// patterns are connected.
+type Parent struct {
+	Upstreams []string
+	Type      string // socks5 or http
+	Address   string
+	Username  string
+	Password  string
+}
+
+// time limit for the parent proxy handshake (s)
+const parentDeadline = 30
+
+const maxConnectResponse = 8192
+
+// LookupParent returns the first parent proxy matching target or nil.
+func LookupParent(parents []Parent, target string) *Parent {
+	for i := range parents {
+		if ManyGlob(parents[i].Upstreams, target) {
+			return &parents[i]
+		}
+	}
+	return nil
+}
+
+func socks5Address(addr string) (buf []byte, err error) {
+	host, portString, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portString, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return nil, errors.New("socks5 hostname too long")
+		}
+		buf = append([]byte{0x03, byte(len(host))}, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		buf = append([]byte{0x01}, ip4...)
+	} else {
+		buf = append([]byte{0x04}, ip.To16()...)
+	}
+	return append(buf, byte(port>>8), byte(port)), nil
+}
+
+// socks5Connect performs a SOCKS5 (RFC 1928, RFC 1929) handshake.
+func (parent *Parent) socks5Connect(conn net.Conn, target string) (err error) {
+	methods := []byte{0x00} // no authentication
+	if parent.Username != "" {
+		methods = []byte{0x02} // username/password
+	}
+	if _, err = conn.Write(append([]byte{0x05, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err = io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != 0x05 || reply[1] != methods[0] {
+		return errors.New("socks5 authentication method not accepted")
+	}
+	if reply[1] == 0x02 {
+		if len(parent.Username) > 255 || len(parent.Password) > 255 {
+			return errors.New("socks5 credentials too long")
+		}
+		auth := append([]byte{0x01, byte(len(parent.Username))}, parent.Username...)
+		auth = append(append(auth, byte(len(parent.Password))), parent.Password...)
+		if _, err = conn.Write(auth); err != nil {
+			return err
+		}
+		if _, err = io.ReadFull(conn, reply); err != nil {
+			return err
+		}
+		if reply[1] != 0x00 {
+			return errors.New("socks5 authentication failed")
+		}
+	}
+	addr, err := socks5Address(target)
+	if err != nil {
+		return err
+	}
+	if _, err = conn.Write(append([]byte{0x05, 0x01, 0x00}, addr...)); err != nil {
+		return err
+	}
+	header := make([]byte, 4)
+	if _, err = io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	if header[0] != 0x05 {
+		return errors.New("invalid socks5 reply")
+	}
+	if header[1] != 0x00 {
+		return errors.New("socks5 connect failed with code " + strconv.Itoa(int(header[1])))
+	}
+	// skip the bound address
+	var skip int
+	switch header[3] {
+	case 0x01:
+		skip = net.IPv4len
+	case 0x04:
+		skip = net.IPv6len
+	case 0x03:
+		length := make([]byte, 1)
+		if _, err = io.ReadFull(conn, length); err != nil {
+			return err
+		}
+		skip = int(length[0])
+	default:
+		return errors.New("invalid socks5 reply")
+	}
+	_, err = io.ReadFull(conn, make([]byte, skip+2))
+	return err
+}
+
+// httpConnect establishes a tunnel with an HTTP CONNECT request.
+func (parent *Parent) httpConnect(conn net.Conn, target string) (err error) {
+	request := "CONNECT " + target + " HTTP/1.1\r\nHost: " + target + "\r\n"
+	if parent.Username != "" {
+		credentials := base64.StdEncoding.EncodeToString([]byte(parent.Username + ":" + parent.Password))
+		request += "Proxy-Authorization: Basic " + credentials + "\r\n"
+	}
+	if _, err = conn.Write([]byte(request + "\r\n")); err != nil {
+		return err
+	}
+	// read byte by byte to avoid consuming data after the response
+	var response []byte
+	b := make([]byte, 1)
+	for !strings.HasSuffix(string(response), "\r\n\r\n") {
+		if len(response) >= maxConnectResponse {
+			return errors.New("parent proxy response too large")
+		}
+		if _, err = io.ReadFull(conn, b); err != nil {
+			return err
+		}
+		response = append(response, b[0])
+	}
+	statusLine := strings.SplitN(string(response), "\r\n", 2)[0]
+	parts := strings.SplitN(statusLine, " ", 3)
+	if len(parts) < 2 || !strings.HasPrefix(parts[0], "HTTP/") || len(parts[1]) != 3 || parts[1][0] != '2' {
+		return errors.New("parent proxy refused connect: " + statusLine)
+	}
+	return nil
+}
+
+// Dial connects to target through the parent proxy.
+func (parent *Parent) Dial(target string) (upstream *net.TCPConn, err error) {
+	paddr, err := net.ResolveTCPAddr("tcp", parent.Address)
+	if err != nil {
+		return nil, err
+	}
+	upstream, err = net.DialTCP("tcp", nil, paddr)
+	if err != nil {
+		return nil, err
+	}
+	SetDeadlineSeconds(upstream, parentDeadline)
+
+	switch parent.Type {
+	case "socks5":
+		err = parent.socks5Connect(upstream, target)
+	case "http":
+		err = parent.httpConnect(upstream, target)
+	default:
+		err = errors.New("unsupported parent proxy type " + strconv.Quote(parent.Type))
+	}
+	if err != nil {
+		upstream.Close()
+		return nil, err
+	}
+	SetDeadlineSeconds(upstream, 0)
+	return upstream, nil
+}
+
+// eof
@@ -0,0 +1,223 @@
+//
+// proxyproto.go
+//
+// Copyright © 2015 Janne Snabb <snabb AT epipe.com>
+//
+// This file is part of Flixproxy.
+//
+// Flixproxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Flixproxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Flixproxy. If not, see <http://www.gnu.org/licenses/>.
+//
+
+package util
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// HAProxy PROXY protocol, see
+// https://www.haproxy.org/download/2.8/doc/proxy-protocol.txt
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// ProxyProtocol selects the PROXY protocol version (1 or 2) sent to
+// upstreams matching the glob patterns.
+type ProxyProtocol struct {
+	Upstreams []string
+	Version   int
+}
+
+// ProxyProtocolVersion returns the PROXY protocol version for target or
+// zero if no header should be sent.
+func ProxyProtocolVersion(rules []ProxyProtocol, target string) int {
+	for _, rule := range rules {
+		if ManyGlob(rule.Upstreams, target) {
+			return rule.Version
+		}
+	}
+	return 0
+}
+
+func tcpAddrIP(addr net.Addr) (ip net.IP, port int, ok bool) {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return nil, 0, false
+	}
+	return tcpAddr.IP, tcpAddr.Port, true
+}
+
+func proxyHeaderV1(src, dst net.Addr) []byte {
+	srcIP, srcPort, srcOk := tcpAddrIP(src)
+	dstIP, dstPort, dstOk := tcpAddrIP(dst)
+	if !srcOk || !dstOk {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+	if srcIP.To4() != nil && dstIP.To4() != nil {
+		return []byte(fmt.Sprintf("PROXY TCP4 %s %s %d %d\r\n",
+			srcIP.To4(), dstIP.To4(), srcPort, dstPort))
+	}
+	return []byte(fmt.Sprintf("PROXY TCP6 %s %s %d %d\r\n",
+		ipv6String(srcIP), ipv6String(dstIP), srcPort, dstPort))
+}
+
+// ipv6String formats ip in IPv6 notation, net.IP.String prints IPv4 and
+// IPv4-mapped addresses as a dotted quad which TCP6 does not allow.
+func ipv6String(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return "::ffff:" + ip4.String()
+	}
+	return ip.String()
+}
+
+func proxyHeaderV2(src, dst net.Addr) []byte {
+	header := append([]byte{}, proxyV2Signature...)
+	header = append(header, 0x21) // version 2, PROXY command
+
+	srcIP, srcPort, srcOk := tcpAddrIP(src)
+	dstIP, dstPort, dstOk := tcpAddrIP(dst)
+	if !srcOk || !dstOk {
+		return append(header, 0x00, 0, 0) // AF_UNSPEC
+	}
+	var addrs []byte
+	if srcIP.To4() != nil && dstIP.To4() != nil {
+		header = append(header, 0x11) // TCP over IPv4
+		addrs = append(append(addrs, srcIP.To4()...), dstIP.To4()...)
+	} else {
+		header = append(header, 0x21) // TCP over IPv6
+		addrs = append(append(addrs, srcIP.To16()...), dstIP.To16()...)
+	}
+	ports := make([]byte, 4)
+	binary.BigEndian.PutUint16(ports[0:], uint16(srcPort))
+	binary.BigEndian.PutUint16(ports[2:], uint16(dstPort))
+	addrs = append(addrs, ports...)
+
+	length := make([]byte, 2)
+	binary.BigEndian.PutUint16(length, uint16(len(addrs)))
+	return append(append(header, length...), addrs...)
+}
+
+// WriteProxyHeader sends a PROXY protocol header conveying the addresses
+// of the downstream connection to upstream.
+func WriteProxyHeader(upstream net.Conn, version int, downstream net.Conn) (err error) {
+	var header []byte
+	switch version {
+	case 1:
+		header = proxyHeaderV1(downstream.RemoteAddr(), downstream.LocalAddr())
+	case 2:
+		header = proxyHeaderV2(downstream.RemoteAddr(), downstream.LocalAddr())
+	default:
+		return errors.New("unsupported PROXY protocol version")
+	}
+	_, err = upstream.Write(header)
+	return err
+}
+
+var errProxyHeader = errors.New("invalid PROXY protocol header")
+
+const maxProxyHeaderV1 = 107
+
+func readProxyHeaderV1(conn net.Conn, prefix []byte) (src, dst net.Addr, err error) {
+	line := prefix
+	b := make([]byte, 1)
+	// read byte by byte to avoid consuming data after the header
+	for len(line) < maxProxyHeaderV1 && (len(line) < 2 || string(line[len(line)-2:]) != "\r\n") {
+		if _, err = io.ReadFull(conn, b); err != nil {
+			return nil, nil, err
+		}
+		line = append(line, b[0])
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) < 2 || !strings.HasSuffix(string(line), "\r\n") {
+		return nil, nil, errProxyHeader
+	}
+	switch fields[1] {
+	case "UNKNOWN":
+		return nil, nil, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, nil, errProxyHeader
+	}
+	if len(fields) != 6 {
+		return nil, nil, errProxyHeader
+	}
+	srcIP, dstIP := net.ParseIP(fields[2]), net.ParseIP(fields[3])
+	srcPort, err1 := strconv.ParseUint(fields[4], 10, 16)
+	dstPort, err2 := strconv.ParseUint(fields[5], 10, 16)
+	if srcIP == nil || dstIP == nil || err1 != nil || err2 != nil {
+		return nil, nil, errProxyHeader
+	}
+	return &net.TCPAddr{IP: srcIP, Port: int(srcPort)},
+		&net.TCPAddr{IP: dstIP, Port: int(dstPort)}, nil
+}
+
+func readProxyHeaderV2(conn net.Conn, prefix []byte) (src, dst net.Addr, err error) {
+	header := make([]byte, 16)
+	copy(header, prefix)
+	if _, err = io.ReadFull(conn, header[len(prefix):]); err != nil {
+		return nil, nil, err
+	}
+	if string(header[:12]) != string(proxyV2Signature) || header[12]>>4 != 2 {
+		return nil, nil, errProxyHeader
+	}
+	body := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err = io.ReadFull(conn, body); err != nil {
+		return nil, nil, err
+	}
+	if header[12]&0xf == 0 {
+		// LOCAL command, keep the real addresses
+		return nil, nil, nil
+	}
+	var ipLen int
+	switch header[13] {
+	case 0x11: // TCP over IPv4
+		ipLen = net.IPv4len
+	case 0x21: // TCP over IPv6
+		ipLen = net.IPv6len
+	default:
+		return nil, nil, nil
+	}
+	if len(body) < 2*ipLen+4 {
+		return nil, nil, errProxyHeader
+	}
+	srcIP := net.IP(body[:ipLen])
+	dstIP := net.IP(body[ipLen : 2*ipLen])
+	srcPort := binary.BigEndian.Uint16(body[2*ipLen:])
+	dstPort := binary.BigEndian.Uint16(body[2*ipLen+2:])
+	return &net.TCPAddr{IP: srcIP, Port: int(srcPort)},
+		&net.TCPAddr{IP: dstIP, Port: int(dstPort)}, nil
+}
+
+// ReadProxyHeader reads a PROXY protocol version 1 or 2 header from conn
+// without reading past it. The returned addresses are nil if the header
+// does not convey them.
+func ReadProxyHeader(conn net.Conn) (src, dst net.Addr, err error) {
+	prefix := make([]byte, 6)
+	if _, err = io.ReadFull(conn, prefix); err != nil {
+		return nil, nil, err
+	}
+	switch {
+	case string(prefix) == "PROXY ":
+		return readProxyHeaderV1(conn, prefix)
+	case string(prefix) == string(proxyV2Signature[:6]):
+		return readProxyHeaderV2(conn, prefix)
+	}
+	return nil, nil, errProxyHeader
+}
+
+// eof
@@ -0,0 +1,123 @@
+//
+// proxyproto_test.go
+//
+// Copyright © 2015 Janne Snabb <snabb AT epipe.com>
+//
+// This file is part of Flixproxy.
+//
+// Flixproxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Flixproxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Flixproxy. If not, see <http://www.gnu.org/licenses/>.
+//
+
+package util
+
+import (
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+// readHeader feeds header followed by payload to ReadProxyHeader and
+// checks that the payload is left unread.
+func readHeader(t *testing.T, header []byte) (src, dst net.Addr, err error) {
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		client.Write(header)
+		client.Write([]byte("payload"))
+		client.Close()
+	}()
+	src, dst, err = ReadProxyHeader(server)
+	if err == nil {
+		rest, _ := ioutil.ReadAll(server)
+		if string(rest) != "payload" {
+			t.Errorf("%q: left %q unread, expected \"payload\"", header, rest)
+		}
+	}
+	return src, dst, err
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	sig := string(proxyV2Signature)
+	tests := []struct {
+		name   string
+		header string
+		src    string
+		dst    string
+		err    bool
+	}{
+		{"v1 tcp4", "PROXY TCP4 192.0.2.1 192.0.2.2 1234 80\r\n", "192.0.2.1:1234", "192.0.2.2:80", false},
+		{"v1 tcp6", "PROXY TCP6 2001:db8::1 2001:db8::2 1234 443\r\n", "[2001:db8::1]:1234", "[2001:db8::2]:443", false},
+		{"v1 mixed", "PROXY TCP6 ::ffff:192.0.2.1 2001:db8::2 1234 443\r\n", "192.0.2.1:1234", "[2001:db8::2]:443", false},
+		{"v1 unknown", "PROXY UNKNOWN\r\n", "", "", false},
+		{"v1 bad family", "PROXY UDP4 192.0.2.1 192.0.2.2 1234 80\r\n", "", "", true},
+		{"v1 bad port", "PROXY TCP4 192.0.2.1 192.0.2.2 1234 65536\r\n", "", "", true},
+		{"v1 missing field", "PROXY TCP4 192.0.2.1 192.0.2.2 1234\r\n", "", "", true},
+		{"v1 truncated", "PROXY TCP4 192.0.2.1 192.0", "", "", true},
+		{"v2 tcp4", sig + "\x21\x11\x00\x0c" +
+			"\xc0\x00\x02\x01\xc0\x00\x02\x02\x04\xd2\x00\x50", "192.0.2.1:1234", "192.0.2.2:80", false},
+		{"v2 tcp6", sig + "\x21\x21\x00\x24" +
+			"\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01" +
+			"\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02" +
+			"\x04\xd2\x01\xbb", "[2001:db8::1]:1234", "[2001:db8::2]:443", false},
+		{"v2 local", sig + "\x20\x11\x00\x0c" +
+			"\xc0\x00\x02\x01\xc0\x00\x02\x02\x04\xd2\x00\x50", "", "", false},
+		{"v2 unspec", sig + "\x21\x00\x00\x00", "", "", false},
+		{"v2 bad version", sig + "\x11\x11\x00\x0c" +
+			"\xc0\x00\x02\x01\xc0\x00\x02\x02\x04\xd2\x00\x50", "", "", true},
+		{"v2 short body", sig + "\x21\x11\x00\x04\xc0\x00\x02\x01", "", "", true},
+		{"v2 truncated", sig + "\x21\x11\x00\x0c\xc0\x00", "", "", true},
+		{"garbage", "GET / HTTP/1.1\r\n", "", "", true},
+	}
+	for _, test := range tests {
+		src, dst, err := readHeader(t, []byte(test.header))
+		if (err != nil) != test.err {
+			t.Errorf("%s: error %v, expected error %v", test.name, err, test.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if test.src == "" {
+			if src != nil || dst != nil {
+				t.Errorf("%s: addresses %v %v, expected none", test.name, src, dst)
+			}
+			continue
+		}
+		if src == nil || dst == nil || src.String() != test.src || dst.String() != test.dst {
+			t.Errorf("%s: addresses %v %v, expected %s %s", test.name, src, dst, test.src, test.dst)
+		}
+	}
+}
+
+func TestProxyHeaderV1(t *testing.T) {
+	tests := []struct {
+		src    string
+		dst    string
+		header string
+	}{
+		{"192.0.2.1:1234", "192.0.2.2:80", "PROXY TCP4 192.0.2.1 192.0.2.2 1234 80\r\n"},
+		{"[2001:db8::1]:1234", "[2001:db8::2]:443", "PROXY TCP6 2001:db8::1 2001:db8::2 1234 443\r\n"},
+		{"192.0.2.1:1234", "[2001:db8::2]:443", "PROXY TCP6 ::ffff:192.0.2.1 2001:db8::2 1234 443\r\n"},
+		{"[2001:db8::1]:1234", "192.0.2.2:80", "PROXY TCP6 2001:db8::1 ::ffff:192.0.2.2 1234 80\r\n"},
+	}
+	for _, test := range tests {
+		src, _ := net.ResolveTCPAddr("tcp", test.src)
+		dst, _ := net.ResolveTCPAddr("tcp", test.dst)
+		if header := string(proxyHeaderV1(src, dst)); header != test.header {
+			t.Errorf("%s %s: header %q, expected %q", test.src, test.dst, header, test.header)
+		}
+	}
+}
+
+// eof
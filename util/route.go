@@ -0,0 +1,99 @@
+//
+// route.go
+//
+// Copyright © 2015 Janne Snabb <snabb AT epipe.com>
+//
+// This file is part of Flixproxy.
+//
+// Flixproxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Flixproxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Flixproxy. If not, see <http://www.gnu.org/licenses/>.
+//
+
+package util
+
+import (
+	"errors"
+	"net"
+	"strings"
+)
+
+// Route maps upstreams matching the glob patterns to explicit backend
+// addresses. The requested port is used for backends without a port and
+// the upstream itself is used if there are no backends. The HTTP proxy
+// also rewrites the Host header and the path prefix of the requests.
+type Route struct {
+	Upstreams []string
+	Backends  []string
+	Host      string // Host header sent upstream
+	Prefix    string // path prefix replaced with Newprefix
+	Newprefix string
+}
+
+// LookupRoute returns the first route matching target or nil.
+func LookupRoute(routes []Route, target string) *Route {
+	for i := range routes {
+		if ManyGlob(routes[i].Upstreams, target) {
+			return &routes[i]
+		}
+	}
+	return nil
+}
+
+func backendAddress(backend string, port string) string {
+	if _, _, err := net.SplitHostPort(backend); err == nil {
+		return backend
+	}
+	backend = strings.TrimSuffix(strings.TrimPrefix(backend, "["), "]")
+	return net.JoinHostPort(backend, port)
+}
+
+// UpstreamAddresses returns the addresses to connect to for target. These
+// are the backends of the matching route or target itself.
+func UpstreamAddresses(routes []Route, target string) (addrs []string) {
+	route := LookupRoute(routes, target)
+	if route == nil || len(route.Backends) == 0 {
+		return []string{target}
+	}
+	_, port, _ := net.SplitHostPort(target)
+	for _, backend := range route.Backends {
+		addrs = append(addrs, backendAddress(backend, port))
+	}
+	return addrs
+}
+
+// DialUpstream connects to target or to the backends of the matching
+// route. Backends are tried in order until one of them accepts the
+// connection. The connection is made through a parent proxy if one
+// matches target.
+func DialUpstream(routes []Route, parents []Parent, target string) (upstream *net.TCPConn, backend string, err error) {
+	parent := LookupParent(parents, target)
+	err = errors.New("no backends")
+	for _, backend = range UpstreamAddresses(routes, target) {
+		if parent != nil {
+			if upstream, err = parent.Dial(backend); err == nil {
+				return upstream, backend, nil
+			}
+			continue
+		}
+		var uaddr *net.TCPAddr
+		if uaddr, err = net.ResolveTCPAddr("tcp", backend); err != nil {
+			continue
+		}
+		if upstream, err = net.DialTCP("tcp", nil, uaddr); err == nil {
+			return upstream, backend, nil
+		}
+	}
+	return nil, backend, err
+}
+
+// eof
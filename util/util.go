@@ -28,6 +28,7 @@ import (
 	"time"
 
 	"github.com/ryanuber/go-glob"
+	"github.com/snabb/flixproxy/access"
 	"gopkg.in/inconshreveable/log15.v2"
 )
 
@@ -96,6 +97,28 @@ func CopyWithIdleTimeout(dst net.Conn, src net.Conn, timeout int64) (written int
 	return written, err
 }
 
+// IdleConn resets the read or write deadline of the connection to Timeout
+// seconds from now before each Read or Write. Deadlines are left
+// untouched if Timeout is zero.
+type IdleConn struct {
+	net.Conn
+	Timeout int64
+}
+
+func (idleConn *IdleConn) Read(b []byte) (n int, err error) {
+	if idleConn.Timeout != 0 {
+		SetReadDeadlineSeconds(idleConn.Conn, idleConn.Timeout)
+	}
+	return idleConn.Conn.Read(b)
+}
+
+func (idleConn *IdleConn) Write(b []byte) (n int, err error) {
+	if idleConn.Timeout != 0 {
+		SetWriteDeadlineSeconds(idleConn.Conn, idleConn.Timeout)
+	}
+	return idleConn.Conn.Write(b)
+}
+
 func ReadBufferedBytes(rd *bufio.Reader) (buf []byte, err error) {
 	count := rd.Buffered()
 	if count == 0 {
@@ -106,11 +129,57 @@ func ReadBufferedBytes(rd *bufio.Reader) (buf []byte, err error) {
 	return buf, err
 }
 
+// Conn is an accepted TCP connection. The addresses are the ones conveyed
+// in a PROXY protocol header if one was received.
+type Conn struct {
+	*net.TCPConn
+	remoteAddr net.Addr
+	localAddr  net.Addr
+}
+
+func (conn *Conn) RemoteAddr() net.Addr {
+	if conn.remoteAddr != nil {
+		return conn.remoteAddr
+	}
+	return conn.TCPConn.RemoteAddr()
+}
+
+func (conn *Conn) LocalAddr() net.Addr {
+	if conn.localAddr != nil {
+		return conn.localAddr
+	}
+	return conn.TCPConn.LocalAddr()
+}
+
 type Handler interface {
-	HandleConn(*net.TCPConn)
+	HandleConn(*Conn)
+}
+
+// time limit for receiving the PROXY protocol header (s)
+const proxyHeaderDeadline = 10
+
+// serveConn reads the PROXY protocol header if the connection comes from
+// a trusted source and passes the connection to handler.
+func serveConn(tcpConn *net.TCPConn, handler Handler, trusted access.Checker, logger log15.Logger) {
+	conn := &Conn{TCPConn: tcpConn}
+
+	if trusted.AllowedAddr(tcpConn.RemoteAddr()) {
+		SetDeadlineSeconds(tcpConn, proxyHeaderDeadline)
+		src, dst, err := ReadProxyHeader(tcpConn)
+		if err != nil {
+			logger.Warn("error reading proxy protocol header", "src", tcpConn.RemoteAddr(), "err", err)
+			tcpConn.Close()
+			return
+		}
+		conn.remoteAddr, conn.localAddr = src, dst
+		SetDeadlineSeconds(tcpConn, 0)
+	}
+	handler.HandleConn(conn)
 }
 
-func ListenAndServe(listen string, handler Handler, logger log15.Logger) {
+// ListenAndServe accepts TCP connections and passes them to handler. A
+// PROXY protocol header is required from the sources allowed by trusted.
+func ListenAndServe(listen string, handler Handler, trusted access.Checker, logger log15.Logger) {
 	logger = logger.New("listen", listen)
 	logger.Info("starting tcp listener")
 	laddr, err := net.ResolveTCPAddr("tcp", listen)
@@ -130,16 +199,38 @@ func ListenAndServe(listen string, handler Handler, logger log15.Logger) {
 			logger.Error("accept error", "err", err)
 			continue
 		}
-		go handler.HandleConn(conn)
+		go serveConn(conn, handler, trusted, logger)
 	}
 }
 
+// ProxyStats describes a connection proxied with Proxy.
+type ProxyStats struct {
+	ToServer int64  // bytes copied from the client to the server
+	ToClient int64  // bytes copied from the server to the client
+	Reason   string // why the connection was terminated
+}
+
+type brokerResult struct {
+	written int64
+	err     error
+}
+
+func closeReason(side string, err error) string {
+	if err == nil {
+		return side + " closed"
+	}
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return "idle timeout"
+	}
+	return side + " error"
+}
+
 // the following is from https://gist.github.com/jbardin/821d08cb64c01c84b81a
 
-func Proxy(srvConn, cliConn *net.TCPConn, timeout int64) {
+func Proxy(srvConn, cliConn *net.TCPConn, timeout int64) (stats ProxyStats) {
 	// channels to wait on the close event for each connection
-	serverClosed := make(chan struct{}, 1)
-	clientClosed := make(chan struct{}, 1)
+	serverClosed := make(chan brokerResult, 1)
+	clientClosed := make(chan brokerResult, 1)
 
 	go broker(srvConn, cliConn, clientClosed, timeout)
 	go broker(cliConn, srvConn, serverClosed, timeout)
@@ -148,43 +239,39 @@ func Proxy(srvConn, cliConn *net.TCPConn, timeout int64) {
 	// the other half by calling CloseRead(). This will break the read
 	// loop in the broker and allow us to fully close the connection
 	// cleanly without a "use of closed network connection" error.
-	var waitFor chan struct{}
 	select {
-	case <-clientClosed:
+	case result := <-clientClosed:
 		// the client closed first and any more packets from the
 		// server aren't useful, so we can optionally SetLinger(0)
 		// here to recycle the port faster.
 		srvConn.SetLinger(0)
 		srvConn.CloseRead()
-		waitFor = serverClosed
-	case <-serverClosed:
+		stats.ToServer = result.written
+		stats.Reason = closeReason("client", result.err)
+		// Wait for the other connection to close.
+		stats.ToClient = (<-serverClosed).written
+	case result := <-serverClosed:
 		cliConn.CloseRead()
-		waitFor = clientClosed
+		stats.ToClient = result.written
+		stats.Reason = closeReason("server", result.err)
+		stats.ToServer = (<-clientClosed).written
 	}
-
-	// Wait for the other connection to close.
-	// This "waitFor" pattern isn't required, but gives us a way to track
-	// the connection and ensure all copies terminate correctly; we can
-	// trigger stats on entry and deferred exit of this function.
-	<-waitFor
+	return stats
 }
 
 // This does the actual data transfer.
 // The broker only closes the Read side.
-func broker(dst, src net.Conn, srcClosed chan struct{}, timeout int64) {
+func broker(dst, src net.Conn, srcClosed chan brokerResult, timeout int64) {
 	// We can handle errors in a finer-grained manner by inlining
 	// io.Copy (it's simple, and we drop the ReaderFrom or WriterTo
 	// checks for net.Conn->net.Conn transfers, which aren't needed).
 	// This would also let us adjust buffersize.
-	_, err := CopyWithIdleTimeout(dst, src, timeout)
+	written, err := CopyWithIdleTimeout(dst, src, timeout)
 
-	if err != nil {
-		// log.Printf("Copy error: %s", err)
-	}
 	if err := src.Close(); err != nil {
 		// log.Printf("Close error: %s", err)
 	}
-	srcClosed <- struct{}{}
+	srcClosed <- brokerResult{written, err}
 }
 
 // eof